@@ -0,0 +1,186 @@
+package traefikgeoip2
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/IncSW/geoip2"
+)
+
+// Anonymous-IP flags, as reported in the anonymizer field.
+const (
+	FlagTorExitNode      = "tor_exit_node"
+	FlagAnonymousVPN     = "anonymous_vpn"
+	FlagPublicProxy      = "public_proxy"
+	FlagHostingProvider  = "hosting_provider"
+	FlagResidentialProxy = "residential_proxy"
+)
+
+// Anonymizer actions, besides allow and deny.
+const (
+	ActionTag      = "tag"
+	ActionRedirect = "redirect"
+)
+
+// Anonymizers part of the configuration, the action taken for each Anonymous-IP flag.
+type Anonymizers struct {
+	TorExitNode      string `json:"torExitNode,omitempty"`
+	AnonymousVPN     string `json:"anonymousVPN,omitempty"`
+	PublicProxy      string `json:"publicProxy,omitempty"`
+	HostingProvider  string `json:"hostingProvider,omitempty"`
+	ResidentialProxy string `json:"residentialProxy,omitempty"`
+	RedirectURL      string `json:"redirectURL,omitempty"`
+}
+
+// anonymizerPolicy maps the flags to their action, flags without action are ignored.
+type anonymizerPolicy struct {
+	actions     map[string]string
+	redirectURL string
+	target      *url.URL
+}
+
+func parseAnonymizers(cfg *Anonymizers) (*anonymizerPolicy, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	p := &anonymizerPolicy{actions: map[string]string{}, redirectURL: cfg.RedirectURL}
+	for flag, action := range map[string]string{
+		FlagTorExitNode:      cfg.TorExitNode,
+		FlagAnonymousVPN:     cfg.AnonymousVPN,
+		FlagPublicProxy:      cfg.PublicProxy,
+		FlagHostingProvider:  cfg.HostingProvider,
+		FlagResidentialProxy: cfg.ResidentialProxy,
+	} {
+		switch action {
+		case "", ActionAllow:
+			continue
+		case ActionDeny, ActionTag:
+		case ActionRedirect:
+			if cfg.RedirectURL == "" {
+				return nil, fmt.Errorf("anonymizer %s redirects without redirectURL", flag)
+			}
+			target, err := url.Parse(cfg.RedirectURL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid anonymizer redirectURL %s: %w", cfg.RedirectURL, err)
+			}
+			p.target = target
+		default:
+			return nil, fmt.Errorf("invalid anonymizer action %s", action)
+		}
+		p.actions[flag] = action
+	}
+	if len(p.actions) == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// evaluate returns the decision for the flags of the record, deny takes precedence over redirect.
+// Requests already on the redirectURL are not redirected again.
+func (p *anonymizerPolicy) evaluate(req *http.Request, record *GeoIPResult) decision {
+	if p == nil {
+		return decision{}
+	}
+	d := decision{}
+	for _, flag := range record.anonymizers {
+		switch p.actions[flag] {
+		case ActionDeny:
+			return decision{action: ActionDeny, reason: "anonymizer:" + flag}
+		case ActionRedirect:
+			if d.action == "" && !onTarget(p.target, req) {
+				d = decision{action: ActionRedirect, reason: "anonymizer:" + flag, location: p.redirectURL}
+			}
+		}
+	}
+	return d
+}
+
+// onTarget reports whether the request is already for the host and path of a redirect target.
+func onTarget(target *url.URL, req *http.Request) bool {
+	sameHost := target.Host == "" || strings.EqualFold(target.Host, req.Host)
+	return sameHost && target.Path == req.URL.Path
+}
+
+// LookupAnonymousIP looks up the Anonymous-IP flags set for an IP.
+type LookupAnonymousIP func(ip net.IP) ([]string, error)
+
+// CreateAnonymousIPDBLookup CreateAnonymousIPDBLookup.
+func CreateAnonymousIPDBLookup(rdr *geoip2.AnonymousIPReader) LookupAnonymousIP {
+	return func(ip net.IP) ([]string, error) {
+		rec, err := rdr.Lookup(ip)
+		if err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		var flags []string
+		for _, f := range []struct {
+			name string
+			set  bool
+		}{
+			{FlagTorExitNode, rec.IsTorExitNode},
+			{FlagAnonymousVPN, rec.IsAnonymousVPN},
+			{FlagPublicProxy, rec.IsPublicProxy},
+			{FlagHostingProvider, rec.IsHostingProvider},
+			{FlagResidentialProxy, rec.IsResidentialProxy},
+		} {
+			if f.set {
+				flags = append(flags, f.name)
+			}
+		}
+		return flags, nil
+	}
+}
+
+func loadAnonymousIPLookup(dbPath string) LookupAnonymousIP {
+	if dbPath == "" {
+		return nil
+	}
+	if _, err := os.Stat(dbPath); err != nil {
+		logErr.Printf("[geoip2] Anonymous-IP DB `%s' not found: %v", dbPath, err)
+		return nil
+	}
+	anonymousIPReadersMu.Lock()
+	defer anonymousIPReadersMu.Unlock()
+	rdr, ok := anonymousIPReaders[dbPath]
+	if !ok {
+		var err error
+		rdr, err = geoip2.NewAnonymousIPReaderFromFile(dbPath)
+		if err != nil {
+			logErr.Printf("[geoip2] Anonymous-IP DB `%s' not initialized: %v", dbPath, err)
+			return nil
+		}
+		anonymousIPReaders[dbPath] = rdr
+	}
+	return CreateAnonymousIPDBLookup(rdr)
+}
+
+// addAnonymizer records the Anonymous-IP flags, the anonymizer field lists the tagged ones.
+func (mw *TraefikGeoIP2) addAnonymizer(record *GeoIPResult, ip net.IP) {
+	if mw.anonymousIPLookup == nil || ip == nil {
+		return
+	}
+	flags, err := mw.anonymousIPLookup(ip)
+	if err != nil {
+		// most addresses are not anonymizers
+		return
+	}
+	record.anonymizers = flags
+	if mw.anonymizers == nil {
+		return
+	}
+	var tagged []string
+	for _, flag := range flags {
+		if mw.anonymizers.actions[flag] == ActionTag {
+			tagged = append(tagged, flag)
+		}
+	}
+	record.set(FieldAnonymizer, strings.Join(tagged, ","))
+}
+
+func (mw *TraefikGeoIP2) redirect(rw http.ResponseWriter, req *http.Request, record *GeoIPResult, d decision) {
+	mw.audit(req, record, d)
+	http.Redirect(rw, req, d.location, http.StatusFound)
+}
@@ -0,0 +1,151 @@
+package traefikgeoip2
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/IncSW/geoip2"
+)
+
+// asnRange an inclusive range of autonomous system numbers.
+type asnRange struct {
+	low  uint32
+	high uint32
+}
+
+// asnRules matches records by AS number or AS organization.
+type asnRules struct {
+	ranges []asnRange
+	orgs   []*regexp.Regexp
+}
+
+// parseASNRules parses numbers (`13335`, `AS13335`), ranges (`64512-65534`)
+// and organization name regexes.
+func parseASNRules(numbers, orgs []string) (*asnRules, error) {
+	if len(numbers) == 0 && len(orgs) == 0 {
+		return nil, nil
+	}
+	rules := &asnRules{}
+	for _, entry := range numbers {
+		low, high := entry, entry
+		if i := strings.Index(entry, "-"); i >= 0 {
+			low, high = entry[:i], entry[i+1:]
+		}
+		lowNum, err := parseASN(low)
+		if err != nil {
+			return nil, err
+		}
+		highNum, err := parseASN(high)
+		if err != nil {
+			return nil, err
+		}
+		if lowNum > highNum {
+			return nil, fmt.Errorf("invalid ASN range %s", entry)
+		}
+		rules.ranges = append(rules.ranges, asnRange{low: lowNum, high: highNum})
+	}
+	for _, expr := range orgs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AS organization pattern %s: %w", expr, err)
+		}
+		rules.orgs = append(rules.orgs, re)
+	}
+	return rules, nil
+}
+
+func parseASN(value string) (uint32, error) {
+	value = strings.TrimSpace(value)
+	if len(value) > 2 && strings.EqualFold(value[:2], "AS") {
+		value = value[2:]
+	}
+	num, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ASN %s", value)
+	}
+	return uint32(num), nil
+}
+
+// match returns the rule matching the record, or an empty string.
+func (r *asnRules) match(record *GeoIPResult) string {
+	if r == nil {
+		return ""
+	}
+	if value, ok := record.get(FieldASN); ok {
+		if num, err := strconv.ParseUint(value, 10, 32); err == nil {
+			for _, rng := range r.ranges {
+				if uint32(num) >= rng.low && uint32(num) <= rng.high {
+					return "asn:AS" + value
+				}
+			}
+		}
+	}
+	if org, ok := record.get(FieldASOrg); ok {
+		for _, re := range r.orgs {
+			if re.MatchString(org) {
+				return "asn_organization:" + re.String()
+			}
+		}
+	}
+	return ""
+}
+
+// LookupASN looks up the AS number and organization of an IP.
+type LookupASN func(ip net.IP) (uint32, string, error)
+
+// CreateASNDBLookup CreateASNDBLookup.
+func CreateASNDBLookup(rdr *geoip2.ASNReader) LookupASN {
+	return func(ip net.IP) (uint32, string, error) {
+		rec, err := rdr.Lookup(ip)
+		if err != nil {
+			return 0, "", fmt.Errorf("%w", err)
+		}
+		return rec.AutonomousSystemNumber, rec.AutonomousSystemOrganization, nil
+	}
+}
+
+func loadASNLookup(dbPath string) LookupASN {
+	if dbPath == "" {
+		return nil
+	}
+	if _, err := os.Stat(dbPath); err != nil {
+		logErr.Printf("[geoip2] ASN DB `%s' not found: %v", dbPath, err)
+		return nil
+	}
+	asnReadersMu.Lock()
+	defer asnReadersMu.Unlock()
+	rdr, ok := asnReaders[dbPath]
+	if !ok {
+		var err error
+		rdr, err = geoip2.NewASNReaderFromFile(dbPath)
+		if err != nil {
+			logErr.Printf("[geoip2] ASN DB `%s' not initialized: %v", dbPath, err)
+			return nil
+		}
+		asnReaders[dbPath] = rdr
+	}
+	return CreateASNDBLookup(rdr)
+}
+
+// addASN completes the record from the ASN database, traits of Enterprise databases take precedence.
+func (mw *TraefikGeoIP2) addASN(record *GeoIPResult, ip net.IP) {
+	if mw.asnLookup == nil || ip == nil {
+		return
+	}
+	if _, ok := record.get(FieldASN); ok {
+		return
+	}
+	num, org, err := mw.asnLookup(ip)
+	if err != nil {
+		logWarn.Printf("Unable to find ASN of `%s', %v", ip, err)
+		return
+	}
+	if num != 0 {
+		record.set(FieldASN, strconv.FormatUint(uint64(num), 10))
+	}
+	record.set(FieldASOrg, org)
+}
@@ -0,0 +1,232 @@
+package traefikgeoip2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// DefaultRequestIDHeader the header holding the request ID shown in block responses.
+const DefaultRequestIDHeader = "X-Request-Id"
+
+// Media types of block responses.
+const (
+	mediaText = "text/plain"
+	mediaJSON = "application/json"
+	mediaHTML = "text/html"
+)
+
+// BlockResponse part of the configuration, the response sent for denied requests.
+type BlockResponse struct {
+	StatusCode int    `json:"statusCode,omitempty"`
+	Body       string `json:"body,omitempty"`
+	BlockedBy  string `json:"blockedBy,omitempty"`
+	// Template files, chosen by the Accept header, Body is the plain text fallback.
+	HTMLTemplate    string            `json:"htmlTemplate,omitempty"`
+	JSONTemplate    string            `json:"jsonTemplate,omitempty"`
+	TextTemplate    string            `json:"textTemplate,omitempty"`
+	RequestIDHeader string            `json:"requestIDHeader,omitempty"`
+	RetryAfter      int               `json:"retryAfter,omitempty"`
+	Headers         map[string]string `json:"headers,omitempty"`
+}
+
+// blockTemplate renders a block response, html/template and text/template share this interface.
+type blockTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+type blockResponse struct {
+	statusCode      int
+	body            string
+	blockedBy       string
+	requestIDHeader string
+	retryAfter      int
+	headers         map[string]string
+	// templates by media type
+	templates map[string]blockTemplate
+}
+
+func parseBlockResponse(cfg *BlockResponse) (*blockResponse, error) {
+	b := &blockResponse{statusCode: http.StatusForbidden, requestIDHeader: DefaultRequestIDHeader}
+	if cfg == nil {
+		return b, nil
+	}
+	if cfg.StatusCode != 0 {
+		if cfg.StatusCode < 400 || cfg.StatusCode > 599 {
+			return nil, fmt.Errorf("invalid block status code %d", cfg.StatusCode)
+		}
+		b.statusCode = cfg.StatusCode
+	}
+	if cfg.RetryAfter < 0 {
+		return nil, fmt.Errorf("invalid block retryAfter %d", cfg.RetryAfter)
+	}
+	b.body = cfg.Body
+	b.blockedBy = cfg.BlockedBy
+	b.retryAfter = cfg.RetryAfter
+	b.headers = cfg.Headers
+	if cfg.RequestIDHeader != "" {
+		b.requestIDHeader = cfg.RequestIDHeader
+	}
+
+	b.templates = map[string]blockTemplate{}
+	for mediaType, path := range map[string]string{
+		mediaHTML: cfg.HTMLTemplate,
+		mediaJSON: cfg.JSONTemplate,
+		mediaText: cfg.TextTemplate,
+	} {
+		if path == "" {
+			continue
+		}
+		tmpl, err := loadBlockTemplate(mediaType, path)
+		if err != nil {
+			return nil, err
+		}
+		b.templates[mediaType] = tmpl
+	}
+	return b, nil
+}
+
+// loadBlockTemplate parses the template and renders it once, so that errors show at startup.
+func loadBlockTemplate(mediaType, path string) (blockTemplate, error) {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read block template: %w", err)
+	}
+	var tmpl blockTemplate
+	if mediaType == mediaHTML {
+		tmpl, err = htmltemplate.New(path).Option("missingkey=zero").Parse(string(text))
+	} else {
+		funcs := template.FuncMap{}
+		if mediaType == mediaJSON {
+			// text/template does not escape, values such as the client's request ID must be quoted
+			funcs["json"] = jsonString
+		}
+		tmpl, err = template.New(path).Option("missingkey=zero").Funcs(funcs).Parse(string(text))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid block template %s: %w", path, err)
+	}
+	if err = tmpl.Execute(ioutil.Discard, map[string]string{}); err != nil {
+		return nil, fmt.Errorf("invalid block template %s: %w", path, err)
+	}
+	return tmpl, nil
+}
+
+// jsonString renders a value as a JSON string, quotes included.
+func jsonString(value string) (string, error) {
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+func (mw *TraefikGeoIP2) block(rw http.ResponseWriter, req *http.Request, record *GeoIPResult, d decision) {
+	mw.audit(req, record, d)
+	mw.blockResponse.write(rw, req, record, d)
+}
+
+func (b *blockResponse) write(rw http.ResponseWriter, req *http.Request, record *GeoIPResult, d decision) {
+	if b.statusCode == http.StatusUnavailableForLegalReasons && b.blockedBy != "" {
+		rw.Header().Set("Link", "<"+b.blockedBy+">; rel=\"blocked-by\"")
+	}
+	if b.retryAfter > 0 {
+		rw.Header().Set("Retry-After", strconv.Itoa(b.retryAfter))
+	}
+	for name, value := range b.headers {
+		rw.Header().Set(name, value)
+	}
+
+	mediaType, body := b.render(req, record, d)
+	rw.Header().Set("Content-Type", mediaType+"; charset=utf-8")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	if len(b.templates) > 0 {
+		rw.Header().Add("Vary", "Accept")
+	}
+	rw.WriteHeader(b.statusCode)
+	_, _ = rw.Write(body)
+}
+
+// render executes the template negotiated by the Accept header, the plain body otherwise.
+func (b *blockResponse) render(req *http.Request, record *GeoIPResult, d decision) (string, []byte) {
+	mediaType := negotiate(req.Header.Get("Accept"), b.templates)
+	if tmpl, ok := b.templates[mediaType]; ok {
+		data := record.templateData()
+		data["RequestID"] = req.Header.Get(b.requestIDHeader)
+		data["Reason"] = d.reason
+		data["StatusCode"] = strconv.Itoa(b.statusCode)
+		data["StatusText"] = http.StatusText(b.statusCode)
+
+		var buf bytes.Buffer
+		err := tmpl.Execute(&buf, data)
+		if err == nil {
+			return mediaType, buf.Bytes()
+		}
+		logErr.Printf("Unable to render block response: %v", err)
+	}
+
+	body := b.body
+	if body == "" {
+		body = http.StatusText(b.statusCode)
+	}
+	return mediaText, []byte(body)
+}
+
+// negotiate returns the media type of the template with the highest quality in Accept,
+// plain text wins ties and is the default without Accept header.
+func negotiate(accept string, templates map[string]blockTemplate) string {
+	if len(templates) == 0 {
+		return ""
+	}
+	type mediaRange struct {
+		mediaType string
+		quality   float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+		if mediaType == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType: mediaType, quality: quality})
+	}
+	if len(ranges) == 0 {
+		ranges = []mediaRange{{mediaType: "*/*", quality: 1}}
+	}
+	// the most specific range decides the quality of a type
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return strings.Count(ranges[i].mediaType, "*") < strings.Count(ranges[j].mediaType, "*")
+	})
+
+	best, bestQuality := "", 0.0
+	for _, mediaType := range []string{mediaText, mediaJSON, mediaHTML} {
+		if _, ok := templates[mediaType]; !ok && mediaType != mediaText {
+			continue
+		}
+		for _, r := range ranges {
+			if r.mediaType == mediaType || r.mediaType == "*/*" ||
+				r.mediaType == strings.SplitN(mediaType, "/", 2)[0]+"/*" {
+				if r.quality > bestQuality {
+					best, bestQuality = mediaType, r.quality
+				}
+				break
+			}
+		}
+	}
+	return best
+}
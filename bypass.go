@@ -0,0 +1,116 @@
+package traefikgeoip2
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Bypass part of the configuration, clients that skip the policy checks.
+// CIDRs starting with `!` are excluded, the longest matching prefix decides.
+type Bypass struct {
+	CIDRs      []string `json:"cidrs,omitempty"`
+	SkipLookup bool     `json:"skipLookup,omitempty"`
+	Header     string   `json:"header,omitempty"`
+	Secret     string   `json:"secret,omitempty"`
+}
+
+type bypass struct {
+	networks   *ipTrie
+	skipLookup bool
+	header     string
+	secret     [sha256.Size]byte
+}
+
+func parseBypass(cfg *Bypass) (*bypass, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if (cfg.Header == "") != (cfg.Secret == "") {
+		return nil, fmt.Errorf("bypass header and secret must be set together")
+	}
+	b := &bypass{networks: &ipTrie{}, skipLookup: cfg.SkipLookup, header: cfg.Header}
+	if cfg.Secret != "" {
+		b.secret = sha256.Sum256([]byte(cfg.Secret))
+	}
+	for _, cidr := range cfg.CIDRs {
+		value := !strings.HasPrefix(cidr, "!")
+		_, ipNet, err := net.ParseCIDR(strings.TrimPrefix(cidr, "!"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid bypass CIDR %s: %w", cidr, err)
+		}
+		b.networks.insert(ipNet, value)
+	}
+	return b, nil
+}
+
+// matches reports whether the request bypasses the policy, the secret header is removed.
+func (b *bypass) matches(req *http.Request, ip net.IP) bool {
+	if b == nil {
+		return false
+	}
+	if b.header != "" {
+		values := req.Header.Values(b.header)
+		req.Header.Del(b.header)
+		for _, value := range values {
+			// hashing first keeps the comparison independent of the secret length
+			sum := sha256.Sum256([]byte(value))
+			if subtle.ConstantTimeCompare(sum[:], b.secret[:]) == 1 {
+				return true
+			}
+		}
+	}
+	return ip != nil && b.networks.lookup(ip)
+}
+
+// ipTrie a binary trie of networks, IPv4 networks are stored as IPv4-mapped IPv6.
+type ipTrie struct {
+	root trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	set      bool
+	value    bool
+}
+
+func (t *ipTrie) insert(ipNet *net.IPNet, value bool) {
+	ones, bits := ipNet.Mask.Size()
+	ip := ipNet.IP.To16()
+	if bits == 8*net.IPv4len {
+		ones += 8 * (net.IPv6len - net.IPv4len)
+	}
+	node := &t.root
+	for i := 0; i < ones; i++ {
+		bit := ip[i/8] >> (7 - uint(i%8)) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.set = true
+	node.value = value
+}
+
+// lookup returns the value of the longest prefix containing the IP, false if none does.
+func (t *ipTrie) lookup(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	node := &t.root
+	value := node.set && node.value
+	for i := 0; i < 8*net.IPv6len; i++ {
+		node = node.children[ip[i/8]>>(7-uint(i%8))&1]
+		if node == nil {
+			break
+		}
+		if node.set {
+			value = node.value
+		}
+	}
+	return value
+}
@@ -0,0 +1,149 @@
+package traefikgeoip2
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cookieSeparator = "|"
+
+// Cookie part of the configuration, the geo fields stored in a cookie for client-side use.
+type Cookie struct {
+	Name     string   `json:"name"`
+	Fields   []string `json:"fields,omitempty"`
+	MaxAge   int      `json:"maxAge,omitempty"`
+	Domain   string   `json:"domain,omitempty"`
+	Path     string   `json:"path,omitempty"`
+	SameSite string   `json:"sameSite,omitempty"`
+	Secure   bool     `json:"secure,omitempty"`
+	HTTPOnly bool     `json:"httpOnly,omitempty"`
+	Secret   string   `json:"secret,omitempty"`
+}
+
+type geoCookie struct {
+	Cookie
+	sameSite http.SameSite
+}
+
+func parseCookie(cfg *Cookie) (*geoCookie, error) {
+	if cfg == nil || cfg.Name == "" {
+		return nil, nil
+	}
+	c := &geoCookie{Cookie: *cfg}
+	if len(c.Fields) == 0 {
+		c.Fields = []string{FieldCountry, FieldRegion, FieldCity}
+	}
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	switch strings.ToLower(c.SameSite) {
+	case "":
+		c.sameSite = http.SameSiteDefaultMode
+	case "lax":
+		c.sameSite = http.SameSiteLaxMode
+	case "strict":
+		c.sameSite = http.SameSiteStrictMode
+	case "none":
+		c.sameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("invalid cookie SameSite %s", c.SameSite)
+	}
+	return c, nil
+}
+
+// fields renders the selected fields, e.g. `DE|BY|Munich`.
+func (c *geoCookie) fields(record *GeoIPResult) string {
+	parts := make([]string, 0, len(c.Fields))
+	for _, field := range c.Fields {
+		value, _ := record.get(field)
+		parts = append(parts, url.PathEscape(value))
+	}
+	return strings.Join(parts, cookieSeparator)
+}
+
+// value appends the issued-at timestamp and the signature to the fields when a secret is set.
+func (c *geoCookie) value(fields string) string {
+	if c.Secret == "" {
+		return fields
+	}
+	value := fields + cookieSeparator + strconv.FormatInt(time.Now().Unix(), 10)
+	return value + cookieSeparator + signCookie(value, c.Secret)
+}
+
+// upToDate reports whether the current value carries the fields, a signed value
+// is renewed once half of maxAge has passed so that it never outlives the cookie.
+func (c *geoCookie) upToDate(current, fields string) bool {
+	if c.Secret == "" {
+		return current == fields
+	}
+	if !strings.HasPrefix(current, fields+cookieSeparator) {
+		return false
+	}
+	_, err := VerifyCookie(current, c.Secret, time.Duration(c.MaxAge)*time.Second/2)
+	return err == nil
+}
+
+// cookie returns the cookie to set, or nil when the request already carries the current value.
+func (c *geoCookie) cookie(req *http.Request, record *GeoIPResult) *http.Cookie {
+	fields := c.fields(record)
+	if current, err := req.Cookie(c.Name); err == nil && c.upToDate(current.Value, fields) {
+		return nil
+	}
+	return &http.Cookie{
+		Name:     c.Name,
+		Value:    c.value(fields),
+		MaxAge:   c.MaxAge,
+		Domain:   c.Domain,
+		Path:     c.Path,
+		SameSite: c.sameSite,
+		Secure:   c.Secure,
+		HttpOnly: c.HTTPOnly,
+	}
+}
+
+func signCookie(value, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyCookie checks the signature of a geo cookie value and returns its fields in the configured order.
+// When maxAge is set, the value must have been issued within maxAge.
+func VerifyCookie(value, secret string, maxAge time.Duration) ([]string, error) {
+	idx := strings.LastIndex(value, cookieSeparator)
+	if idx == -1 {
+		return nil, errors.New("geo cookie is not signed")
+	}
+	expected := signCookie(value[:idx], secret)
+	if !hmac.Equal([]byte(expected), []byte(value[idx+1:])) {
+		return nil, errors.New("invalid geo cookie signature")
+	}
+	parts := strings.Split(value[:idx], cookieSeparator)
+	issued, err := strconv.ParseInt(parts[len(parts)-1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed geo cookie timestamp: %w", err)
+	}
+	if maxAge > 0 {
+		age := time.Since(time.Unix(issued, 0))
+		if age > maxAge || age < -maxAge {
+			return nil, errors.New("expired geo cookie")
+		}
+	}
+	parts = parts[:len(parts)-1]
+	for i, part := range parts {
+		unescaped, err := url.PathUnescape(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid geo cookie field: %w", err)
+		}
+		parts[i] = unescaped
+	}
+	return parts, nil
+}
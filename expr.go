@@ -0,0 +1,725 @@
+package traefikgeoip2
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxExprDepth bounds the nesting of expressions.
+const maxExprDepth = 64
+
+// exprEnv the values an expression sees.
+type exprEnv struct {
+	req    *http.Request
+	record *GeoIPResult
+}
+
+// exprNode a compiled expression, it evaluates to a string, float64, bool, []interface{} list,
+// http.Header or url.Values, nil for missing values.
+type exprNode interface {
+	eval(env *exprEnv) interface{}
+}
+
+// anonymousAliases maps the members of `anonymous` to Anonymous-IP flags.
+func anonymousAliases() map[string]string {
+	return map[string]string{
+		"tor":                FlagTorExitNode,
+		"vpn":                FlagAnonymousVPN,
+		"proxy":              FlagPublicProxy,
+		"hosting":            FlagHostingProvider,
+		"residential":        FlagResidentialProxy,
+		FlagTorExitNode:      FlagTorExitNode,
+		FlagAnonymousVPN:     FlagAnonymousVPN,
+		FlagPublicProxy:      FlagPublicProxy,
+		FlagHostingProvider:  FlagHostingProvider,
+		FlagResidentialProxy: FlagResidentialProxy,
+	}
+}
+
+// exprFields the result fields known to expressions, by type.
+func exprFields() map[string]string {
+	return map[string]string{
+		FieldCountry:     "string",
+		FieldCountryName: "string",
+		FieldContinent:   "string",
+		FieldRegion:      "string",
+		FieldRegionName:  "string",
+		FieldCity:        "string",
+		FieldOrg:         "string",
+		FieldASOrg:       "string",
+		FieldRule:        "string",
+		FieldASN:         "number",
+		FieldLatitude:    "number",
+		FieldLongitude:   "number",
+		FieldAccuracy:    "number",
+		FieldEU:          "bool",
+		FieldSubdivision: "list",
+		FieldAnonymizer:  "list",
+		FieldGeofence:    "list",
+	}
+}
+
+// ActionHeader sets a request header for the requests matching an expression.
+const ActionHeader = "header"
+
+// Expression part of the configuration, an action for the requests matching When,
+// e.g. `country in ["US","CA"] && !anonymous.vpn || asn == 13335`.
+type Expression struct {
+	Name string `json:"name,omitempty"`
+	When string `json:"when"`
+	// Action deny, tag, redirect to Target, or header to set Header to Value.
+	Action string `json:"action"`
+	Target string `json:"target,omitempty"`
+	Header string `json:"header,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+type expression struct {
+	name   string
+	when   exprNode
+	action string
+	target string
+	header string
+	value  string
+	// the parsed target, requests already on it are not redirected
+	targetURL *url.URL
+}
+
+func parseExpressions(cfgs []Expression) ([]*expression, error) {
+	exprs := make([]*expression, 0, len(cfgs))
+	for i, cfg := range cfgs {
+		e := &expression{
+			name:   cfg.Name,
+			action: cfg.Action,
+			target: cfg.Target,
+			header: cfg.Header,
+			value:  cfg.Value,
+		}
+		if e.name == "" {
+			e.name = strconv.Itoa(i)
+		}
+		switch cfg.Action {
+		case ActionDeny, ActionTag:
+		case ActionRedirect:
+			if cfg.Target == "" {
+				return nil, fmt.Errorf("expression %s redirects without target", e.name)
+			}
+			target, err := url.Parse(cfg.Target)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target of expression %s: %w", e.name, err)
+			}
+			e.targetURL = target
+		case ActionHeader:
+			if cfg.Header == "" {
+				return nil, fmt.Errorf("expression %s sets no header", e.name)
+			}
+		default:
+			return nil, fmt.Errorf("invalid action `%s' of expression %s", cfg.Action, e.name)
+		}
+		when, err := compileExpr(cfg.When)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression %s: %w", e.name, err)
+		}
+		e.when = when
+		exprs = append(exprs, e)
+	}
+	return exprs, nil
+}
+
+// applyExpressions tags the record and sets headers for the matching expressions,
+// it returns the decision of the first matching deny or redirect expression.
+func (mw *TraefikGeoIP2) applyExpressions(req *http.Request, record *GeoIPResult) decision {
+	if len(mw.expressions) == 0 {
+		return decision{}
+	}
+	env := &exprEnv{req: req, record: record}
+	var (
+		d    decision
+		tags []string
+	)
+	for _, e := range mw.expressions {
+		if !truthy(e.when.eval(env)) {
+			continue
+		}
+		switch e.action {
+		case ActionTag:
+			tags = append(tags, e.name)
+		case ActionHeader:
+			req.Header.Set(e.header, e.value)
+		case ActionRedirect:
+			if d.action == "" && !onTarget(e.targetURL, req) {
+				d = decision{action: e.action, reason: "expression:" + e.name, location: e.target}
+			}
+		default:
+			if d.action == "" {
+				d = decision{action: e.action, reason: "expression:" + e.name, location: e.target}
+			}
+		}
+	}
+	record.set(FieldTags, strings.Join(tags, ","))
+	return d
+}
+
+// compileExpr parses an expression, unknown identifiers and invalid patterns are errors.
+func compileExpr(text string) (exprNode, error) {
+	tokens, err := lexExpr(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected `%s' at %d", tok.text, tok.pos)
+	}
+	return node, nil
+}
+
+// Lexer
+
+const (
+	tokEOF = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type exprToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+func lexExpr(text string) ([]exprToken, error) {
+	var tokens []exprToken
+	i := 0
+	for i < len(text) {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			start := i
+			var b strings.Builder
+			i++
+			for ; i < len(text) && text[i] != c; i++ {
+				if text[i] == '\\' && i+1 < len(text) {
+					i++
+					switch text[i] {
+					case 'n':
+						b.WriteByte('\n')
+					case 't':
+						b.WriteByte('\t')
+					default:
+						b.WriteByte(text[i])
+					}
+					continue
+				}
+				b.WriteByte(text[i])
+			}
+			if i >= len(text) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			i++
+			tokens = append(tokens, exprToken{kind: tokString, text: b.String(), pos: start})
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(text) && (text[i] >= '0' && text[i] <= '9' || text[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokNumber, text: text[start:i], pos: start})
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(text) && (text[i] == '_' || text[i] >= 'a' && text[i] <= 'z' ||
+				text[i] >= 'A' && text[i] <= 'Z' || text[i] >= '0' && text[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokIdent, text: text[start:i], pos: start})
+		default:
+			op := ""
+			for _, candidate := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ",", ".", "-"} {
+				if strings.HasPrefix(text[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character `%c' at %d", c, i)
+			}
+			tokens = append(tokens, exprToken{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, exprToken{kind: tokEOF, text: "end of expression", pos: len(text)}), nil
+}
+
+// Parser
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *exprParser) accept(kind int, text string) bool {
+	if tok := p.peek(); tok.kind == kind && tok.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(text string) error {
+	if !p.accept(tokOp, text) {
+		tok := p.peek()
+		return fmt.Errorf("expected `%s' at %d, got `%s'", text, tok.pos, tok.text)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr(depth int) (exprNode, error) {
+	if depth > maxExprDepth {
+		return nil, fmt.Errorf("expression nested too deeply")
+	}
+	left, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokOp, "||") {
+		right, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{or: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd(depth int) (exprNode, error) {
+	left, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokOp, "&&") {
+		right, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary(depth int) (exprNode, error) {
+	if depth > maxExprDepth {
+		return nil, fmt.Errorf("expression nested too deeply")
+	}
+	if p.accept(tokOp, "!") {
+		operand, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parseComparison(depth)
+}
+
+func (p *exprParser) parseComparison(depth int) (exprNode, error) {
+	left, err := p.parsePostfix(depth)
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	switch {
+	case tok.kind == tokOp && (tok.text == "==" || tok.text == "!=" || tok.text == "<" ||
+		tok.text == "<=" || tok.text == ">" || tok.text == ">="),
+		tok.kind == tokIdent && tok.text == "in":
+		p.next()
+		right, err := p.parsePostfix(depth)
+		if err != nil {
+			return nil, err
+		}
+		return &compareNode{op: tok.text, left: left, right: right}, nil
+	case tok.kind == tokIdent && tok.text == "matches":
+		p.next()
+		pattern := p.next()
+		if pattern.kind != tokString {
+			return nil, fmt.Errorf("matches needs a string pattern at %d", pattern.pos)
+		}
+		re, err := regexp.Compile(pattern.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern at %d: %w", pattern.pos, err)
+		}
+		return &matchNode{operand: left, re: re}, nil
+	}
+	return left, nil
+}
+
+func (p *exprParser) parsePostfix(depth int) (exprNode, error) {
+	node, err := p.parsePrimary(depth)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept(tokOp, "."):
+			member := p.next()
+			if member.kind != tokIdent {
+				return nil, fmt.Errorf("expected member name at %d", member.pos)
+			}
+			if v, ok := node.(*varNode); ok && v.name == "anonymous" {
+				flag, known := anonymousAliases()[member.text]
+				if !known {
+					return nil, fmt.Errorf("unknown anonymizer flag %s", member.text)
+				}
+				node = &flagNode{flag: flag}
+				continue
+			}
+			node = &indexNode{operand: node, index: &literalNode{value: member.text}}
+		case p.accept(tokOp, "["):
+			index, err := p.parseOr(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect("]"); err != nil {
+				return nil, err
+			}
+			node = &indexNode{operand: node, index: index}
+		default:
+			if v, ok := node.(*varNode); ok && v.name == "anonymous" {
+				return &flagNode{}, nil
+			}
+			return node, nil
+		}
+	}
+}
+
+func (p *exprParser) parsePrimary(depth int) (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokString:
+		return &literalNode{value: tok.text}, nil
+	case tokNumber:
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s at %d", tok.text, tok.pos)
+		}
+		return &literalNode{value: n}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null":
+			return &literalNode{}, nil
+		case "host", "path", "method", "ip", "status", "source", "header", "query", "anonymous":
+			return &varNode{name: tok.text}, nil
+		}
+		if kind, ok := exprFields()[tok.text]; ok {
+			return &fieldNode{field: tok.text, kind: kind}, nil
+		}
+		return nil, fmt.Errorf("unknown identifier %s at %d", tok.text, tok.pos)
+	case tokOp:
+		switch tok.text {
+		case "(":
+			node, err := p.parseOr(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expect(")")
+		case "[":
+			list := &listNode{}
+			for !p.accept(tokOp, "]") {
+				if len(list.items) > 0 {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+				item, err := p.parseOr(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				list.items = append(list.items, item)
+			}
+			return list, nil
+		case "-":
+			number := p.next()
+			n, err := strconv.ParseFloat(number.text, 64)
+			if number.kind != tokNumber || err != nil {
+				return nil, fmt.Errorf("expected number at %d", number.pos)
+			}
+			return &literalNode{value: -n}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected `%s' at %d", tok.text, tok.pos)
+}
+
+// Nodes
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(env *exprEnv) interface{} {
+	return n.value
+}
+
+type listNode struct {
+	items []exprNode
+}
+
+func (n *listNode) eval(env *exprEnv) interface{} {
+	values := make([]interface{}, len(n.items))
+	for i, item := range n.items {
+		values[i] = item.eval(env)
+	}
+	return values
+}
+
+type varNode struct {
+	name string
+}
+
+func (n *varNode) eval(env *exprEnv) interface{} {
+	switch n.name {
+	case "host":
+		return env.req.Host
+	case "path":
+		return env.req.URL.Path
+	case "method":
+		return env.req.Method
+	case "ip":
+		return clientIP(env.req)
+	case "status":
+		return env.record.status
+	case "source":
+		return env.record.source
+	case "header":
+		return env.req.Header
+	case "query":
+		return env.req.URL.Query()
+	}
+	return nil
+}
+
+type fieldNode struct {
+	field string
+	kind  string
+}
+
+func (n *fieldNode) eval(env *exprEnv) interface{} {
+	value, ok := env.record.get(n.field)
+	if !ok {
+		return nil
+	}
+	switch n.kind {
+	case "number":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil
+		}
+		return f
+	case "bool":
+		return value == "true"
+	case "list":
+		var list []interface{}
+		for _, item := range strings.Split(value, ",") {
+			list = append(list, item)
+		}
+		return list
+	}
+	return value
+}
+
+// flagNode reports an Anonymous-IP flag, without flag whether any is set.
+type flagNode struct {
+	flag string
+}
+
+func (n *flagNode) eval(env *exprEnv) interface{} {
+	for _, flag := range env.record.anonymizers {
+		if n.flag == "" || flag == n.flag {
+			return true
+		}
+	}
+	return false
+}
+
+type indexNode struct {
+	operand exprNode
+	index   exprNode
+}
+
+func (n *indexNode) eval(env *exprEnv) interface{} {
+	index := n.index.eval(env)
+	switch v := n.operand.eval(env).(type) {
+	case http.Header:
+		if key, ok := index.(string); ok && len(v.Values(key)) > 0 {
+			return v.Get(key)
+		}
+	case url.Values:
+		if key, ok := index.(string); ok && len(v[key]) > 0 {
+			return v.Get(key)
+		}
+	case []interface{}:
+		if i, ok := index.(float64); ok && i >= 0 && int(i) < len(v) {
+			return v[int(i)]
+		}
+	}
+	return nil
+}
+
+type logicalNode struct {
+	or          bool
+	left, right exprNode
+}
+
+func (n *logicalNode) eval(env *exprEnv) interface{} {
+	left := truthy(n.left.eval(env))
+	if left == n.or {
+		return left
+	}
+	return truthy(n.right.eval(env))
+}
+
+type notNode struct {
+	operand exprNode
+}
+
+func (n *notNode) eval(env *exprEnv) interface{} {
+	return !truthy(n.operand.eval(env))
+}
+
+type matchNode struct {
+	operand exprNode
+	re      *regexp.Regexp
+}
+
+func (n *matchNode) eval(env *exprEnv) interface{} {
+	s, ok := n.operand.eval(env).(string)
+	return ok && n.re.MatchString(s)
+}
+
+type compareNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *compareNode) eval(env *exprEnv) interface{} {
+	left, right := n.left.eval(env), n.right.eval(env)
+	switch n.op {
+	case "==":
+		return exprEqual(left, right)
+	case "!=":
+		return !exprEqual(left, right)
+	case "in":
+		switch r := right.(type) {
+		case []interface{}:
+			for _, item := range r {
+				if exprEqual(left, item) {
+					return true
+				}
+			}
+		case string:
+			s, ok := left.(string)
+			return ok && strings.Contains(r, s)
+		}
+		return false
+	}
+
+	var cmp int
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case l < r:
+			cmp = -1
+		case l > r:
+			cmp = 1
+		}
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(l, r)
+	default:
+		return false
+	}
+	switch n.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+func exprEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case nil:
+		return b == nil
+	case string:
+		y, ok := b.(string)
+		return ok && x == y
+	case float64:
+		y, ok := b.(float64)
+		return ok && x == y
+	case bool:
+		y, ok := b.(bool)
+		return ok && x == y
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !exprEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func truthy(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	case string:
+		return x != ""
+	case float64:
+		return x != 0
+	case []interface{}:
+		return len(x) > 0
+	}
+	return true
+}
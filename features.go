@@ -0,0 +1,112 @@
+package traefikgeoip2
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// DefaultFeatureFlagsHeader the header listing the active feature flags.
+const DefaultFeatureFlagsHeader = "X-Feature-Flags"
+
+// FeatureFlag part of the configuration, a flag active for the listed markets,
+// any market without lists. Percentage rolls the flag out to a share of the clients.
+type FeatureFlag struct {
+	Name         string   `json:"name"`
+	Countries    []string `json:"countries,omitempty"`
+	Continents   []string `json:"continents,omitempty"`
+	Subdivisions []string `json:"subdivisions,omitempty"`
+	ASNs         []string `json:"asns,omitempty"`
+	Percentage   *float64 `json:"percentage,omitempty"`
+}
+
+type featureFlag struct {
+	name         string
+	countries    map[string]bool
+	continents   map[string]bool
+	subdivisions map[string]bool
+	asns         *asnRules
+	// share of the clients in basis points
+	rollout uint32
+}
+
+func parseFeatureFlags(cfgs []FeatureFlag) ([]*featureFlag, error) {
+	flags := make([]*featureFlag, 0, len(cfgs))
+	names := map[string]bool{}
+	for _, cfg := range cfgs {
+		if cfg.Name == "" || strings.ContainsAny(cfg.Name, ", ") || names[cfg.Name] {
+			return nil, fmt.Errorf("invalid or duplicate feature flag name `%s'", cfg.Name)
+		}
+		names[cfg.Name] = true
+
+		asns, err := parseASNRules(cfg.ASNs, nil)
+		if err != nil {
+			return nil, fmt.Errorf("feature flag %s: %w", cfg.Name, err)
+		}
+		f := &featureFlag{
+			name:         cfg.Name,
+			countries:    countrySet(cfg.Countries),
+			continents:   countrySet(cfg.Continents),
+			subdivisions: countrySet(cfg.Subdivisions),
+			asns:         asns,
+			rollout:      10000,
+		}
+		if cfg.Percentage != nil {
+			if *cfg.Percentage < 0 || *cfg.Percentage > 100 {
+				return nil, fmt.Errorf("invalid percentage %v of feature flag %s", *cfg.Percentage, cfg.Name)
+			}
+			f.rollout = uint32(math.Round(*cfg.Percentage * 100))
+		}
+		flags = append(flags, f)
+	}
+	return flags, nil
+}
+
+// active reports whether the flag is on for the record and client.
+func (f *featureFlag) active(record *GeoIPResult, ip net.IP) bool {
+	if f.countries != nil || f.continents != nil || f.subdivisions != nil || f.asns != nil {
+		country, _ := record.get(FieldCountry)
+		continent, _ := record.get(FieldContinent)
+		subdivisions, _ := record.get(FieldSubdivision)
+		market := f.countries[strings.ToUpper(country)] || f.continents[strings.ToUpper(continent)] ||
+			f.asns.match(record) != ""
+		for _, code := range strings.Split(subdivisions, ",") {
+			market = market || f.subdivisions[strings.ToUpper(code)]
+		}
+		if !market {
+			return false
+		}
+	}
+	if f.rollout >= 10000 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	// the flag name salts the bucket, so rollouts of different flags are independent
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(f.name + "|" + clientKey(ip)))
+	return h.Sum32()%10000 < f.rollout
+}
+
+// addFeatureFlags lists the active flags in the feature flags header and field.
+func (mw *TraefikGeoIP2) addFeatureFlags(req *http.Request, record *GeoIPResult, ip net.IP) {
+	if len(mw.featureFlags) == 0 {
+		return
+	}
+	var active []string
+	for _, f := range mw.featureFlags {
+		if f.active(record, ip) {
+			active = append(active, f.name)
+		}
+	}
+	if len(active) == 0 {
+		return
+	}
+	value := strings.Join(active, ",")
+	record.set(FieldFeatureFlags, value)
+	req.Header.Set(mw.featureFlagsHeader, value)
+}
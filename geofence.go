@@ -0,0 +1,260 @@
+package traefikgeoip2
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const earthRadiusKm = 6371.0
+
+// Geofence part of the configuration, a named zone given by a center and radius
+// or by the polygons of a GeoJSON file.
+type Geofence struct {
+	Name      string  `json:"name"`
+	Latitude  float64 `json:"latitude,omitempty"`
+	Longitude float64 `json:"longitude,omitempty"`
+	RadiusKm  float64 `json:"radiusKm,omitempty"`
+	GeoJSON   string  `json:"geoJSON,omitempty"`
+	// MaxAccuracyRadius the largest accuracy radius in km a location may have to match, 0 for any.
+	MaxAccuracyRadius int `json:"maxAccuracyRadius,omitempty"`
+	// Action allow or deny, fences without action only tag the request.
+	Action string `json:"action,omitempty"`
+}
+
+// point a longitude and latitude pair, in GeoJSON order.
+type point [2]float64
+
+// polygon an outer ring followed by its holes.
+type polygon [][]point
+
+type geofence struct {
+	name        string
+	lat, lon    float64
+	radiusKm    float64
+	polygons    []polygon
+	maxAccuracy int
+	action      string
+}
+
+type geofences struct {
+	fences []*geofence
+	// requests outside every allow fence are denied
+	allow bool
+}
+
+func parseGeofences(cfgs []Geofence) (*geofences, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+	g := &geofences{}
+	names := map[string]bool{}
+	for _, cfg := range cfgs {
+		if cfg.Name == "" || strings.Contains(cfg.Name, ",") || names[cfg.Name] {
+			return nil, fmt.Errorf("invalid or duplicate geofence name `%s'", cfg.Name)
+		}
+		names[cfg.Name] = true
+
+		switch cfg.Action {
+		case "":
+		case ActionAllow:
+			g.allow = true
+		case ActionDeny:
+		default:
+			return nil, fmt.Errorf("invalid geofence action %s", cfg.Action)
+		}
+
+		fence := &geofence{
+			name:        cfg.Name,
+			lat:         cfg.Latitude,
+			lon:         cfg.Longitude,
+			radiusKm:    cfg.RadiusKm,
+			maxAccuracy: cfg.MaxAccuracyRadius,
+			action:      cfg.Action,
+		}
+		switch {
+		case cfg.GeoJSON != "":
+			polygons, err := loadGeoJSON(cfg.GeoJSON)
+			if err != nil {
+				return nil, fmt.Errorf("geofence %s: %w", cfg.Name, err)
+			}
+			fence.polygons = polygons
+		case cfg.RadiusKm <= 0:
+			return nil, fmt.Errorf("geofence %s needs a radiusKm or a geoJSON file", cfg.Name)
+		}
+		g.fences = append(g.fences, fence)
+	}
+	return g, nil
+}
+
+// geoJSON the subset of GeoJSON holding polygons.
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometry    *geoJSON        `json:"geometry"`
+	Geometries  []geoJSON       `json:"geometries"`
+	Features    []geoJSON       `json:"features"`
+}
+
+func loadGeoJSON(path string) ([]polygon, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc geoJSON
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON %s: %w", path, err)
+	}
+	polygons, err := doc.polygons()
+	if err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON %s: %w", path, err)
+	}
+	if len(polygons) == 0 {
+		return nil, fmt.Errorf("GeoJSON %s has no polygon", path)
+	}
+	return polygons, nil
+}
+
+func (g *geoJSON) polygons() ([]polygon, error) {
+	switch g.Type {
+	case "Polygon":
+		var p polygon
+		if err := json.Unmarshal(g.Coordinates, &p); err != nil {
+			return nil, err
+		}
+		return []polygon{p}, nil
+	case "MultiPolygon":
+		var ps []polygon
+		if err := json.Unmarshal(g.Coordinates, &ps); err != nil {
+			return nil, err
+		}
+		return ps, nil
+	case "Feature":
+		if g.Geometry == nil {
+			return nil, nil
+		}
+		return g.Geometry.polygons()
+	case "FeatureCollection", "GeometryCollection":
+		var ps []polygon
+		for _, children := range [][]geoJSON{g.Features, g.Geometries} {
+			for i := range children {
+				child, err := children[i].polygons()
+				if err != nil {
+					return nil, err
+				}
+				ps = append(ps, child...)
+			}
+		}
+		return ps, nil
+	default:
+		// points and lines enclose no area
+		return nil, nil
+	}
+}
+
+func (f *geofence) contains(lat, lon float64) bool {
+	if len(f.polygons) == 0 {
+		return haversineKm(f.lat, f.lon, lat, lon) <= f.radiusKm
+	}
+	for _, p := range f.polygons {
+		if len(p) == 0 || !inRing(p[0], lat, lon) {
+			continue
+		}
+		inHole := false
+		for _, hole := range p[1:] {
+			if inRing(hole, lat, lon) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
+
+// inRing tests a point against a ring by ray casting.
+func inRing(ring []point, lat, lon float64) bool {
+	in := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			in = !in
+		}
+	}
+	return in
+}
+
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// addGeofence lists the fences containing the location in the geofence field.
+func (mw *TraefikGeoIP2) addGeofence(record *GeoIPResult) {
+	if mw.geofences == nil {
+		return
+	}
+	latStr, okLat := record.get(FieldLatitude)
+	lonStr, okLon := record.get(FieldLongitude)
+	if !okLat || !okLon {
+		return
+	}
+	lat, errLat := strconv.ParseFloat(latStr, 64)
+	lon, errLon := strconv.ParseFloat(lonStr, 64)
+	if errLat != nil || errLon != nil {
+		return
+	}
+	accuracy := -1
+	if value, ok := record.get(FieldAccuracy); ok {
+		accuracy, _ = strconv.Atoi(value)
+	}
+
+	var names []string
+	for _, f := range mw.geofences.fences {
+		if f.maxAccuracy > 0 && (accuracy < 0 || accuracy > f.maxAccuracy) {
+			continue
+		}
+		if f.contains(lat, lon) {
+			names = append(names, f.name)
+		}
+	}
+	record.set(FieldGeofence, strings.Join(names, ","))
+}
+
+// evaluate denies requests inside a deny fence or outside every allow fence.
+func (g *geofences) evaluate(record *GeoIPResult) decision {
+	if g == nil {
+		return decision{}
+	}
+	value, _ := record.get(FieldGeofence)
+	inside := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		inside[name] = true
+	}
+	allowed := false
+	for _, f := range g.fences {
+		if !inside[f.name] {
+			continue
+		}
+		switch f.action {
+		case ActionDeny:
+			return decision{action: ActionDeny, reason: "geofence:" + f.name}
+		case ActionAllow:
+			allowed = true
+		}
+	}
+	if g.allow && !allowed {
+		return decision{action: ActionDeny, reason: "geofence:outside"}
+	}
+	return decision{}
+}
@@ -0,0 +1,134 @@
+package traefikgeoip2
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Header value transforms.
+const (
+	TransformLowercase = "lowercase"
+	TransformUppercase = "uppercase"
+	TransformAlpha3    = "alpha3"
+)
+
+// Header part of the configuration, a header written from a result field.
+type Header struct {
+	Name      string `json:"name"`
+	Transform string `json:"transform,omitempty"`
+	Encoding  string `json:"encoding,omitempty"`
+	Prefix    string `json:"prefix,omitempty"`
+	Suffix    string `json:"suffix,omitempty"`
+}
+
+// Headers part of the configuration, maps result field identifiers
+// to a header name, a list of header names or a list of Header.
+type Headers map[string]interface{}
+
+type fieldHeader struct {
+	field string
+	Header
+}
+
+func (h *fieldHeader) apply(value string) string {
+	switch h.Transform {
+	case TransformLowercase:
+		value = strings.ToLower(value)
+	case TransformUppercase:
+		value = strings.ToUpper(value)
+	case TransformAlpha3:
+		if alpha3, ok := countryAlpha3[strings.ToUpper(value)]; ok {
+			value = alpha3
+		}
+	}
+	return h.Prefix + encodeValue(value, h.Encoding) + h.Suffix
+}
+
+func parseHeaders(headers Headers) ([]fieldHeader, error) {
+	var result []fieldHeader
+	for field, value := range headers {
+		field = strings.ToLower(field)
+		list, err := headerList(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid headers for field %s: %w", field, err)
+		}
+		for _, h := range list {
+			if h.Name == "" {
+				continue
+			}
+			switch h.Transform {
+			case "", TransformLowercase, TransformUppercase, TransformAlpha3:
+			default:
+				return nil, fmt.Errorf("invalid transform for header %s: %s", h.Name, h.Transform)
+			}
+			switch h.Encoding {
+			case "", EncodingRaw, EncodingASCII, EncodingPercent, EncodingRFC8187, EncodingBase64:
+			default:
+				return nil, fmt.Errorf("invalid encoding for header %s: %s", h.Name, h.Encoding)
+			}
+			result = append(result, fieldHeader{field: field, Header: h})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].field != result[j].field {
+			return result[i].field < result[j].field
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+func headerList(value interface{}) ([]Header, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []Header{{Name: v}}, nil
+	case Header:
+		return []Header{v}, nil
+	case []Header:
+		return v, nil
+	case []string:
+		list := make([]Header, 0, len(v))
+		for _, name := range v {
+			list = append(list, Header{Name: name})
+		}
+		return list, nil
+	case map[string]interface{}:
+		var h Header
+		for key, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid value of %s: %v", key, item)
+			}
+			switch strings.ToLower(key) {
+			case "name":
+				h.Name = s
+			case "transform":
+				h.Transform = s
+			case "encoding":
+				h.Encoding = s
+			case "prefix":
+				h.Prefix = s
+			case "suffix":
+				h.Suffix = s
+			default:
+				return nil, fmt.Errorf("unknown header setting %s", key)
+			}
+		}
+		return []Header{h}, nil
+	case []interface{}:
+		var list []Header
+		for _, item := range v {
+			items, err := headerList(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, items...)
+		}
+		return list, nil
+	default:
+		return nil, fmt.Errorf("unsupported value %T", value)
+	}
+}
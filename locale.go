@@ -0,0 +1,159 @@
+package traefikgeoip2
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultStaticExtensions the extensions of static assets, never rewritten.
+const DefaultStaticExtensions = ".css,.js,.mjs,.map,.png,.jpg,.jpeg,.gif,.svg,.webp,.avif,.ico,.woff,.woff2,.ttf,.txt,.xml,.json"
+
+// LocaleRewrite part of the configuration, prefixes request paths with the visitor's locale.
+type LocaleRewrite struct {
+	// Countries maps a country to its locales, e.g. `CH: de,fr,it`,
+	// Accept-Language picks among several, the first one is the fallback.
+	Countries         map[string]string `json:"countries"`
+	Default           string            `json:"default,omitempty"`
+	ExcludePaths      []string          `json:"excludePaths,omitempty"`
+	ExcludeExtensions []string          `json:"excludeExtensions,omitempty"`
+}
+
+type localeRewrite struct {
+	countries    map[string][]string
+	fallback     string
+	locales      map[string]bool
+	excludePaths []string
+	extensions   map[string]bool
+}
+
+func parseLocaleRewrite(cfg *LocaleRewrite) (*localeRewrite, error) {
+	if cfg == nil || (len(cfg.Countries) == 0 && cfg.Default == "") {
+		return nil, nil
+	}
+	l := &localeRewrite{
+		countries:    make(map[string][]string, len(cfg.Countries)),
+		fallback:     cfg.Default,
+		locales:      map[string]bool{},
+		excludePaths: cfg.ExcludePaths,
+		extensions:   map[string]bool{},
+	}
+	for country, list := range cfg.Countries {
+		var locales []string
+		for _, locale := range strings.Split(list, ",") {
+			locale = strings.TrimSpace(locale)
+			if locale == "" || strings.Contains(locale, "/") {
+				return nil, fmt.Errorf("invalid locale `%s' for %s", locale, country)
+			}
+			locales = append(locales, locale)
+			l.locales[strings.ToLower(locale)] = true
+		}
+		l.countries[strings.ToUpper(country)] = locales
+	}
+	if strings.Contains(l.fallback, "/") {
+		return nil, fmt.Errorf("invalid default locale `%s'", l.fallback)
+	}
+	if l.fallback != "" {
+		l.locales[strings.ToLower(l.fallback)] = true
+	}
+
+	extensions := cfg.ExcludeExtensions
+	if extensions == nil {
+		extensions = strings.Split(DefaultStaticExtensions, ",")
+	}
+	for _, ext := range extensions {
+		l.extensions[strings.ToLower(ext)] = true
+	}
+	return l, nil
+}
+
+// rewrite prefixes the request path with the locale of the visitor.
+func (l *localeRewrite) rewrite(req *http.Request, record *GeoIPResult) {
+	if l == nil || l.excluded(req.URL.Path) {
+		return
+	}
+	country, _ := record.get(FieldCountry)
+	locale := l.fallback
+	if locales := l.countries[strings.ToUpper(country)]; len(locales) > 0 {
+		locale = pickLocale(locales, req.Header.Get("Accept-Language"))
+	}
+	if locale == "" {
+		return
+	}
+
+	req.URL.Path = "/" + locale + req.URL.Path
+	if req.URL.RawPath != "" {
+		req.URL.RawPath = "/" + locale + req.URL.RawPath
+	}
+	req.RequestURI = req.URL.RequestURI()
+}
+
+// excluded reports paths already prefixed with a locale, static assets and excluded paths.
+func (l *localeRewrite) excluded(p string) bool {
+	first := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)[0]
+	if l.locales[strings.ToLower(first)] {
+		return true
+	}
+	if l.extensions[strings.ToLower(path.Ext(p))] {
+		return true
+	}
+	for _, prefix := range l.excludePaths {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type languageRange struct {
+	tag     string
+	quality float64
+}
+
+// pickLocale returns the locale preferred by the Accept-Language header, the first locale otherwise.
+func pickLocale(locales []string, acceptLanguage string) string {
+	var ranges []languageRange
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			ranges = append(ranges, languageRange{tag: tag, quality: quality})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].quality > ranges[j].quality })
+
+	for _, r := range ranges {
+		for _, locale := range locales {
+			if languageMatches(strings.ToLower(locale), r.tag) {
+				return locale
+			}
+		}
+	}
+	return locales[0]
+}
+
+// languageMatches compares the tags, or their primary language when one has no region.
+func languageMatches(locale, tag string) bool {
+	locale = strings.ReplaceAll(locale, "_", "-")
+	if locale == tag {
+		return true
+	}
+	localePrimary := strings.SplitN(locale, "-", 2)[0]
+	tagPrimary := strings.SplitN(tag, "-", 2)[0]
+	return (locale == localePrimary || tag == tagPrimary) && localePrimary == tagPrimary
+}
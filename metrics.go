@@ -0,0 +1,73 @@
+package traefikgeoip2
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metrics counts the decisions of one middleware instance.
+type metrics struct {
+	mu     sync.Mutex
+	counts map[metricKey]uint64
+}
+
+type metricKey struct {
+	action     string
+	reason     string
+	reportOnly bool
+}
+
+func newMetrics() *metrics {
+	return &metrics{counts: map[metricKey]uint64{}}
+}
+
+func (m *metrics) count(d decision) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.counts[metricKey{action: d.action, reason: d.reason, reportOnly: d.reportOnly}]++
+	m.mu.Unlock()
+}
+
+// serveMetrics writes the counters in the Prometheus text format.
+func (mw *TraefikGeoIP2) serveMetrics(rw http.ResponseWriter) {
+	mw.metrics.mu.Lock()
+	keys := make([]metricKey, 0, len(mw.metrics.counts))
+	for key := range mw.metrics.counts {
+		keys = append(keys, key)
+	}
+	counts := make([]uint64, len(keys))
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].action != keys[j].action {
+			return keys[i].action < keys[j].action
+		}
+		if keys[i].reason != keys[j].reason {
+			return keys[i].reason < keys[j].reason
+		}
+		return !keys[i].reportOnly && keys[j].reportOnly
+	})
+	for i, key := range keys {
+		counts[i] = mw.metrics.counts[key]
+	}
+	mw.metrics.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# HELP geoip2_decisions_total Requests denied or redirected by the geo policy.\n")
+	b.WriteString("# TYPE geoip2_decisions_total counter\n")
+	for i, key := range keys {
+		fmt.Fprintf(&b, "geoip2_decisions_total{middleware=\"%s\",action=\"%s\",reason=\"%s\",report_only=\"%s\"} %d\n",
+			escapeLabel(mw.name), escapeLabel(key.action), escapeLabel(key.reason),
+			strconv.FormatBool(key.reportOnly), counts[i])
+	}
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = rw.Write([]byte(b.String()))
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
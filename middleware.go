@@ -3,18 +3,23 @@ package traefikgeoip2
 
 import (
 	"context"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/IncSW/geoip2"
 	// cache "github.com/patrickmn/go-cache"
 )
 
 type LocationRewrite struct {
+	Name      string `json:"name,omitempty"`
 	IpRange   string `json:"ipRange"`
 	Country   string `json:"country,omitempty"`
 	Region    string `json:"region,omitempty"`
@@ -28,59 +33,182 @@ var (
 	logInfo = log.New(ioutil.Discard, "geoip2-", log.Ldate|log.Ltime|log.Lshortfile)
 	logWarn = log.New(ioutil.Discard, "geoip2-", log.Ldate|log.Ltime|log.Lshortfile)
 	logErr  = log.New(ioutil.Discard, "geoip2-", log.Ldate|log.Ltime|log.Lshortfile)
+	// denied requests are always audited
+	logAudit = log.New(os.Stdout, "geoip2-audit ", log.Ldate|log.Ltime|log.LUTC)
 )
 
-// Headers part of the configuration
-type Headers struct {
-	Country   string `json:"country"`
-	Region    string `json:"region"`
-	City      string `json:"city"`
-	Latitude  string `json:"latitude"`
-	Longitude string `json:"longitude"`
+// Missing part of the configuration, how a header is written when its field was not found.
+type Missing struct {
+	Mode        string `json:"mode,omitempty"`
+	Placeholder string `json:"placeholder,omitempty"`
+}
+
+// Database part of the configuration, any MMDB-format file
+// with a mapping from dotted field paths to header names.
+type Database struct {
+	Path   string            `json:"path"`
+	Fields map[string]string `json:"fields"`
 }
 
 // Config the plugin configuration.
 type Config struct {
-	DBPath           string            `json:"dbPath,omitempty"`
-	Headers          *Headers          `json:"headers"`
-	LocationRewrites []LocationRewrite `json:"locationRewrites,omitempty"`
+	DBPath             string             `json:"dbPath,omitempty"`
+	ASNDBPath          string             `json:"asnDBPath,omitempty"`
+	AnonymousIPDBPath  string             `json:"anonymousIPDBPath,omitempty"`
+	Headers            Headers            `json:"headers"`
+	LocationRewrites   []LocationRewrite  `json:"locationRewrites,omitempty"`
+	Databases          []Database         `json:"databases,omitempty"`
+	Missing            *Missing           `json:"missing,omitempty"`
+	MissingHeaders     map[string]Missing `json:"missingHeaders,omitempty"`
+	StatusHeader       string             `json:"statusHeader,omitempty"`
+	SourceHeader       string             `json:"sourceHeader,omitempty"`
+	JSONHeader         *JSONHeader        `json:"jsonHeader,omitempty"`
+	HeaderTemplates    map[string]string  `json:"headerTemplates,omitempty"`
+	ResponseHeaders    Headers            `json:"responseHeaders,omitempty"`
+	Vary               bool               `json:"vary,omitempty"`
+	Cookie             *Cookie            `json:"cookie,omitempty"`
+	Signature          *Signature         `json:"signature,omitempty"`
+	StructuredHeader   string             `json:"structuredHeader,omitempty"`
+	AllowCountries     []string           `json:"allowCountries,omitempty"`
+	DenyCountries      []string           `json:"denyCountries,omitempty"`
+	UnknownCountry     string             `json:"unknownCountry,omitempty"`
+	PrivateIP          string             `json:"privateIP,omitempty"`
+	DenySubdivisions   []string           `json:"denySubdivisions,omitempty"`
+	Presets            []string           `json:"presets,omitempty"`
+	PresetOverrides    map[string]Preset  `json:"presetOverrides,omitempty"`
+	AllowASNs          []string           `json:"allowASNs,omitempty"`
+	DenyASNs           []string           `json:"denyASNs,omitempty"`
+	AllowASOrgs        []string           `json:"allowASOrgs,omitempty"`
+	DenyASOrgs         []string           `json:"denyASOrgs,omitempty"`
+	Anonymizers        *Anonymizers       `json:"anonymizers,omitempty"`
+	Geofences          []Geofence         `json:"geofences,omitempty"`
+	Redirects          *Redirects         `json:"redirects,omitempty"`
+	LocaleRewrite      *LocaleRewrite     `json:"localeRewrite,omitempty"`
+	Rules              []Rule             `json:"rules,omitempty"`
+	ReportOnly         bool               `json:"reportOnly,omitempty"`
+	MetricsPath        string             `json:"metricsPath,omitempty"`
+	RateLimits         []RateLimit        `json:"rateLimits,omitempty"`
+	Bypass             *Bypass            `json:"bypass,omitempty"`
+	Expressions        []Expression       `json:"expressions,omitempty"`
+	FeatureFlags       []FeatureFlag      `json:"featureFlags,omitempty"`
+	FeatureFlagsHeader string             `json:"featureFlagsHeader,omitempty"`
+	Block              *BlockResponse     `json:"block,omitempty"`
 }
 
-func ResetLookup() {}
+// ResetLookup drops the database readers shared between instances.
+func ResetLookup() {
+	CityReader = nil
+	CountryReader = nil
+	mmdbReadersMu.Lock()
+	mmdbReaders = map[string]*MMDBReader{}
+	mmdbReadersMu.Unlock()
+	asnReadersMu.Lock()
+	asnReaders = map[string]*geoip2.ASNReader{}
+	asnReadersMu.Unlock()
+	anonymousIPReadersMu.Lock()
+	anonymousIPReaders = map[string]*geoip2.AnonymousIPReader{}
+	anonymousIPReadersMu.Unlock()
+}
 
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *Config {
 	return &Config{
 		DBPath: "GeoLite2-Country.mmdb",
-		Headers: &Headers{
-			Country:   "Geoip_Country",
-			Region:    "Geoip_Region",
-			City:      "Geoip_City",
-			Latitude:  "Geoip_Latitude",
-			Longitude: "Geoip_Longitude",
+		Headers: Headers{
+			FieldCountry:   "Geoip_Country",
+			FieldRegion:    "Geoip_Region",
+			FieldCity:      "Geoip_City",
+			FieldLatitude:  "Geoip_Latitude",
+			FieldLongitude: "Geoip_Longitude",
+		},
+		Missing: &Missing{
+			Mode:        MissingPlaceholder,
+			Placeholder: Unknown,
 		},
 	}
 }
 
 // TraefikGeoIP2 a traefik geoip2 plugin.
 type TraefikGeoIP2 struct {
-	next             http.Handler
-	lookup           LookupGeoIP2
-	name             string
-	locationRewrites []LocationRewrite
-	headers          *Headers
+	next               http.Handler
+	lookup             LookupGeoIP2
+	asnLookup          LookupASN
+	anonymousIPLookup  LookupAnonymousIP
+	name               string
+	locationRewrites   []LocationRewrite
+	headers            []fieldHeader
+	databases          []*database
+	missing            Missing
+	missingHeaders     map[string]Missing
+	source             string
+	statusHeader       string
+	sourceHeader       string
+	jsonHeader         *JSONHeader
+	templates          []headerTemplate
+	responseHeaders    []fieldHeader
+	vary               []string
+	cookie             *geoCookie
+	signature          *signer
+	strip              []string
+	structuredHeader   string
+	policy             *policy
+	blockResponse      *blockResponse
+	anonymizers        *anonymizerPolicy
+	geofences          *geofences
+	redirects          *redirects
+	localeRewrite      *localeRewrite
+	rules              []*rule
+	reportOnly         bool
+	metricsPath        string
+	metrics            *metrics
+	rateLimits         []*rateLimiter
+	bypass             *bypass
+	expressions        []*expression
+	featureFlags       []*featureFlag
+	featureFlagsHeader string
 	// cache            *cache.Cache
 }
 
+type database struct {
+	path   string
+	reader *MMDBReader
+	fields []databaseField
+}
+
+type databaseField struct {
+	path   string
+	header string
+}
+
 var CityReader *geoip2.CityReader
 var CountryReader *geoip2.CountryReader
 
+var (
+	mmdbReaders   = map[string]*MMDBReader{}
+	mmdbReadersMu sync.Mutex
+)
+
+// mmdbMetadataMarker precedes the metadata section of MMDB files.
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+var (
+	asnReaders   = map[string]*geoip2.ASNReader{}
+	asnReadersMu sync.Mutex
+)
+
+var (
+	anonymousIPReaders   = map[string]*geoip2.AnonymousIPReader{}
+	anonymousIPReadersMu sync.Mutex
+)
+
 // New created a new TraefikGeoIP2 plugin.
 func New(ctx context.Context, next http.Handler, cfg *Config, name string) (http.Handler, error) {
 	var err error
 	for i := range cfg.LocationRewrites {
 		_, cfg.LocationRewrites[i].IPnet, err = net.ParseCIDR(cfg.LocationRewrites[i].IpRange)
 		if err != nil {
+			logErr.Printf("[geoip2] invalid location rewrite ipRange `%s', requests are passed on unchecked: %v",
+				cfg.LocationRewrites[i].IpRange, err)
 			break
 		}
 	}
@@ -93,69 +221,326 @@ func New(ctx context.Context, next http.Handler, cfg *Config, name string) (http
 		}, nil
 	}
 
-	if _, err := os.Stat(cfg.DBPath); err != nil {
-		logErr.Printf("[geoip2] DB `%s' not found: %v", cfg.DBPath, err)
-		return &TraefikGeoIP2{
-			lookup:           nil,
-			next:             next,
-			name:             name,
-			locationRewrites: cfg.LocationRewrites,
-			// cache:            nil,
-		}, nil
+	missing := Missing{Mode: MissingPlaceholder, Placeholder: Unknown}
+	if cfg.Missing != nil {
+		missing = *cfg.Missing
+	}
+	missingHeaders := make(map[string]Missing, len(cfg.MissingHeaders))
+	for name, m := range cfg.MissingHeaders {
+		missingHeaders[http.CanonicalHeaderKey(name)] = m
+	}
+
+	if cfg.JSONHeader != nil && cfg.JSONHeader.Encoding != "" &&
+		cfg.JSONHeader.Encoding != EncodingJSON && cfg.JSONHeader.Encoding != EncodingBase64URL {
+		logErr.Printf("[geoip2] unknown JSON header encoding `%s', using `%s'", cfg.JSONHeader.Encoding, EncodingJSON)
+		cfg.JSONHeader.Encoding = EncodingJSON
+	}
+
+	headers, err := parseHeaders(cfg.Headers)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := parseHeaderTemplates(cfg.HeaderTemplates)
+	if err != nil {
+		return nil, err
+	}
+	responseHeaders, err := parseHeaders(cfg.ResponseHeaders)
+	if err != nil {
+		return nil, err
+	}
+	cookie, err := parseCookie(cfg.Cookie)
+	if err != nil {
+		return nil, err
+	}
+	var vary []string
+	if cfg.Vary {
+		for _, h := range headers {
+			vary = append(vary, h.Name)
+		}
+	}
+
+	databases := loadDatabases(cfg.Databases)
+	featureFlagsHeader := cfg.FeatureFlagsHeader
+	if featureFlagsHeader == "" {
+		featureFlagsHeader = DefaultFeatureFlagsHeader
+	}
+
+	// geo headers belong to the middleware, values sent by the client are dropped
+	strip := make([]string, 0, len(headers)+len(templates)+3)
+	for _, h := range headers {
+		strip = append(strip, h.Name)
+	}
+	for _, ht := range templates {
+		strip = append(strip, ht.name)
+	}
+	// from the configuration, the headers of a database that failed to load are dropped as well
+	for _, db := range cfg.Databases {
+		for _, header := range db.Fields {
+			strip = append(strip, header)
+		}
+	}
+	for _, e := range cfg.Expressions {
+		if e.Action == ActionHeader && e.Header != "" {
+			strip = append(strip, e.Header)
+		}
+	}
+	for _, name := range []string{cfg.StatusHeader, cfg.SourceHeader, cfg.StructuredHeader} {
+		if name != "" {
+			strip = append(strip, name)
+		}
+	}
+	if cfg.JSONHeader != nil && cfg.JSONHeader.Name != "" {
+		strip = append(strip, cfg.JSONHeader.Name)
+	}
+	strip = append(strip, WouldBlockHeader)
+	if len(cfg.FeatureFlags) > 0 {
+		strip = append(strip, featureFlagsHeader)
+	}
+
+	signature, err := parseSignature(cfg.Signature, strip)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := parsePolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+	blockResponse, err := parseBlockResponse(cfg.Block)
+	if err != nil {
+		return nil, err
+	}
+	anonymizers, err := parseAnonymizers(cfg.Anonymizers)
+	if err != nil {
+		return nil, err
+	}
+	geofences, err := parseGeofences(cfg.Geofences)
+	if err != nil {
+		return nil, err
+	}
+	redirects, err := parseRedirects(cfg.Redirects)
+	if err != nil {
+		return nil, err
+	}
+	localeRewrite, err := parseLocaleRewrite(cfg.LocaleRewrite)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := parseRules(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+	rateLimits, err := parseRateLimits(cfg.RateLimits)
+	if err != nil {
+		return nil, err
+	}
+	bypass, err := parseBypass(cfg.Bypass)
+	if err != nil {
+		return nil, err
+	}
+	expressions, err := parseExpressions(cfg.Expressions)
+	if err != nil {
+		return nil, err
+	}
+	featureFlags, err := parseFeatureFlags(cfg.FeatureFlags)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TraefikGeoIP2{
+		lookup:             loadLookup(cfg.DBPath),
+		asnLookup:          loadASNLookup(cfg.ASNDBPath),
+		anonymousIPLookup:  loadAnonymousIPLookup(cfg.AnonymousIPDBPath),
+		next:               next,
+		name:               name,
+		locationRewrites:   cfg.LocationRewrites,
+		headers:            headers,
+		databases:          databases,
+		missing:            missing,
+		missingHeaders:     missingHeaders,
+		source:             strings.TrimSuffix(filepath.Base(cfg.DBPath), filepath.Ext(cfg.DBPath)),
+		statusHeader:       cfg.StatusHeader,
+		sourceHeader:       cfg.SourceHeader,
+		jsonHeader:         cfg.JSONHeader,
+		templates:          templates,
+		responseHeaders:    responseHeaders,
+		vary:               vary,
+		cookie:             cookie,
+		signature:          signature,
+		strip:              strip,
+		structuredHeader:   cfg.StructuredHeader,
+		policy:             policy,
+		blockResponse:      blockResponse,
+		anonymizers:        anonymizers,
+		geofences:          geofences,
+		redirects:          redirects,
+		localeRewrite:      localeRewrite,
+		rules:              rules,
+		reportOnly:         cfg.ReportOnly,
+		metricsPath:        cfg.MetricsPath,
+		metrics:            newMetrics(),
+		rateLimits:         rateLimits,
+		bypass:             bypass,
+		expressions:        expressions,
+		featureFlags:       featureFlags,
+		featureFlagsHeader: featureFlagsHeader,
+		// cache:            cache.New(DefaultCacheExpire, DefaultCachePurge),
+	}, nil
+}
+
+func loadLookup(dbPath string) LookupGeoIP2 {
+	if _, err := os.Stat(dbPath); err != nil {
+		logErr.Printf("[geoip2] DB `%s' not found: %v", dbPath, err)
+		return nil
 	}
 
 	var lookup LookupGeoIP2
-	if strings.Contains(cfg.DBPath, "City") {
+	if strings.Contains(dbPath, "City") {
 		var err error = nil
 		if CityReader == nil {
-			CityReader, err = geoip2.NewCityReaderFromFile(cfg.DBPath)
+			CityReader, err = geoip2.NewCityReaderFromFile(dbPath)
 		}
 		if err != nil {
-			logErr.Printf("[geoip2] DB `%s' not initialized: %v", cfg.DBPath, err)
+			logErr.Printf("[geoip2] DB `%s' not initialized: %v", dbPath, err)
 		} else {
 			lookup = CreateCityDBLookup(CityReader)
 		}
 	}
 
-	if strings.Contains(cfg.DBPath, "Country") {
+	if strings.Contains(dbPath, "Country") {
 		var err error = nil
 		if CountryReader == nil {
-			CountryReader, err = geoip2.NewCountryReaderFromFile(cfg.DBPath)
+			CountryReader, err = geoip2.NewCountryReaderFromFile(dbPath)
 		}
 		if err != nil {
-			logErr.Printf("[geoip2] DB `%s' not initialized: %v", cfg.DBPath, err)
+			logErr.Printf("[geoip2] DB `%s' not initialized: %v", dbPath, err)
 		} else {
 			lookup = CreateCountryDBLookup(CountryReader)
 		}
 	}
+	return lookup
+}
 
-	return &TraefikGeoIP2{
-		lookup:           lookup,
-		next:             next,
-		name:             name,
-		locationRewrites: cfg.LocationRewrites,
-		headers:          cfg.Headers,
-		// cache:            cache.New(DefaultCacheExpire, DefaultCachePurge),
-	}, nil
+func loadDatabases(cfgs []Database) []*database {
+	var dbs []*database
+	for _, cfg := range cfgs {
+		mmdbReadersMu.Lock()
+		rdr, ok := mmdbReaders[cfg.Path]
+		if !ok {
+			var err error
+			rdr, err = NewMMDBReaderFromFile(cfg.Path)
+			if err != nil {
+				mmdbReadersMu.Unlock()
+				logErr.Printf("[geoip2] DB `%s' not initialized: %v", cfg.Path, err)
+				continue
+			}
+			mmdbReaders[cfg.Path] = rdr
+		}
+		mmdbReadersMu.Unlock()
+
+		db := &database{path: cfg.Path, reader: rdr}
+		for path, header := range cfg.Fields {
+			db.fields = append(db.fields, databaseField{path: path, header: header})
+		}
+		sort.Slice(db.fields, func(i, j int) bool { return db.fields[i].path < db.fields[j].path })
+		dbs = append(dbs, db)
+	}
+	return dbs
 }
 
 func (mw *TraefikGeoIP2) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if mw.metricsPath != "" && req.URL.Path == mw.metricsPath {
+		mw.serveMetrics(rw)
+		return
+	}
 
-	if mw.lookup == nil {
-		logErr.Println("The db path must contains City/Country")
+	ipStr := clientIP(req)
+	ip := net.ParseIP(ipStr)
+
+	for _, name := range mw.strip {
+		req.Header.Del(name)
+	}
+	bypassed := mw.bypass.matches(req, ip)
+	if bypassed && mw.bypass.skipLookup {
 		mw.next.ServeHTTP(rw, req)
 		return
 	}
+	mw.addDatabaseHeaders(req, ip)
 
-	ipStr := req.Header.Get(RealIPHeader)
-	if ipStr == "" {
-		ipStr = req.RemoteAddr
-		tmp, _, err := net.SplitHostPort(ipStr)
-		if err == nil {
-			ipStr = tmp
+	record := mw.lookupRecord(ip, ipStr)
+	mw.addASN(record, ip)
+	mw.addAnonymizer(record, ip)
+	mw.addGeofence(record)
+	matched := matchRule(mw.rules, req, record)
+	if matched != nil {
+		record.set(FieldRule, matched.name)
+	}
+	exprDecision := mw.applyExpressions(req, record)
+	mw.addFeatureFlags(req, record, ip)
+	if record.status == StatusDBUnavailable {
+		mw.addStatusHeaders(req, record)
+		mw.addJSONHeader(req, record)
+		mw.addTemplateHeaders(req, record)
+	} else {
+		mw.addHeaders(req, record)
+	}
+
+	var d decision
+	if !bypassed {
+		d = mw.evaluate(req, record, matched)
+		if d.action == "" {
+			d = exprDecision
+		}
+		if d.action == "" {
+			d = mw.rateLimit(record, ip)
 		}
 	}
-	ip := net.ParseIP(ipStr)
+	if (d.action == ActionDeny || d.action == ActionRedirect || d.action == ActionRateLimit) &&
+		(mw.reportOnly || (matched != nil && matched.reportOnly)) {
+		mw.report(req, record, d)
+		d = decision{}
+	}
+	var geoRedirect decision
+	if d.action == "" {
+		geoRedirect = mw.redirects.decide(rw, req, record)
+		if geoRedirect.action != "" && mw.reportOnly {
+			mw.report(req, record, geoRedirect)
+			geoRedirect = decision{}
+		}
+	}
+	// signed last so the would-block header is covered as well
+	mw.addSignatureHeader(req, ipStr)
+	switch d.action {
+	case ActionDeny:
+		mw.block(rw, req, record, d)
+		return
+	case ActionRedirect:
+		mw.redirect(rw, req, record, d)
+		return
+	case ActionRateLimit:
+		mw.tooManyRequests(rw, d)
+		return
+	}
+	if geoRedirect.action != "" {
+		mw.redirects.redirect(rw, req, geoRedirect)
+		return
+	}
+	mw.localeRewrite.rewrite(req, record)
+
+	wrapped := mw.wrapResponse(rw, req, record)
+	mw.next.ServeHTTP(wrapped, req)
+	if w, ok := wrapped.(*responseWriter); ok {
+		// the backend may return without writing, net/http then sends the header map as is
+		w.injectHeaders()
+	}
+}
+
+func (mw *TraefikGeoIP2) lookupRecord(ip net.IP, ipStr string) *GeoIPResult {
+	if mw.lookup == nil {
+		logErr.Println("The db path must contains City/Country")
+		record := newGeoIPResult()
+		record.status = StatusDBUnavailable
+		return record
+	}
 
 	var (
 		record *GeoIPResult
@@ -165,57 +550,136 @@ func (mw *TraefikGeoIP2) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	// if c, found := mw.cache.Get(ipStr); found {
 	// 	record = c.(*GeoIPResult)
 	// } else {
-	record, err = mw.lookup(net.ParseIP(ipStr))
-	if err != nil {
-		record, err = mw.findLocalRewrite(ip)
-	}
-	if err != nil {
-		logWarn.Printf("Unable to find GeoIP data for `%s', %v", ipStr, err)
-		record = &GeoIPResult{
-			country:   Unknown,
-			region:    Unknown,
-			city:      Unknown,
-			latitude:  Unknown,
-			longitude: Unknown,
+	if ip == nil {
+		logWarn.Printf("Invalid client IP `%s'", ipStr)
+		record = newGeoIPResult()
+		record.status = StatusInvalidIP
+	} else {
+		record, err = mw.lookup(ip)
+		if err == nil {
+			record.status = StatusOK
+			record.source = mw.source
+		} else {
+			lookupErr := err
+			record, err = mw.findLocalRewrite(ip)
+			if err != nil {
+				logWarn.Printf("Unable to find GeoIP data for `%s', %v", ipStr, lookupErr)
+				record = newGeoIPResult()
+				switch {
+				case !errors.Is(lookupErr, geoip2.ErrNotFound):
+					record.status = StatusError
+				case ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast():
+					record.status = StatusPrivate
+				default:
+					record.status = StatusNotFound
+				}
+			}
 		}
 	}
 	// 	mw.cache.Set(ipStr, record, cache.DefaultExpiration)
 	// }
 
-	mw.addHeaders(req, record)
+	return record
+}
+
+func clientIP(req *http.Request) string {
+	ipStr := req.Header.Get(RealIPHeader)
+	if ipStr == "" {
+		ipStr = req.RemoteAddr
+		tmp, _, err := net.SplitHostPort(ipStr)
+		if err == nil {
+			ipStr = tmp
+		}
+	}
+	return ipStr
+}
 
-	mw.next.ServeHTTP(rw, req)
+func (mw *TraefikGeoIP2) addDatabaseHeaders(req *http.Request, ip net.IP) {
+	for _, db := range mw.databases {
+		if ip == nil {
+			for _, f := range db.fields {
+				mw.setHeader(req.Header, f.header, "", false)
+			}
+			continue
+		}
+		record, err := db.reader.Lookup(ip)
+		if err != nil {
+			logWarn.Printf("Unable to find `%s' in `%s', %v", ip, db.path, err)
+		}
+		for _, f := range db.fields {
+			value, ok := LookupPath(record, f.path)
+			mw.setHeader(req.Header, f.header, FormatValue(value), ok)
+		}
+	}
 }
 
 func (mw *TraefikGeoIP2) findLocalRewrite(ip net.IP) (*GeoIPResult, error) {
 	for _, lr := range mw.locationRewrites {
 		if lr.IPnet.Contains(ip) {
-			return &GeoIPResult{
-				country:   lr.Country,
-				region:    lr.Region,
-				city:      lr.City,
-				longitude: lr.Longitude,
-				latitude:  lr.Latitude,
-			}, nil
+			record := newGeoIPResult()
+			record.set(FieldCountry, lr.Country)
+			record.set(FieldRegion, lr.Region)
+			record.set(FieldCity, lr.City)
+			record.set(FieldLatitude, lr.Latitude)
+			record.set(FieldLongitude, lr.Longitude)
+			if lr.Country != "" && lr.Region != "" {
+				record.set(FieldSubdivision, lr.Country+"-"+lr.Region)
+			}
+			record.status = StatusRewrite
+			record.source = lr.Name
+			if record.source == "" {
+				record.source = lr.IpRange
+			}
+			return record, nil
 		}
 	}
 	return nil, geoip2.ErrNotFound
 }
 
 func (a *TraefikGeoIP2) addHeaders(req *http.Request, record *GeoIPResult) {
-	if a.headers.Country != "" {
-		req.Header.Add(a.headers.Country, record.country)
+	if a.jsonHeader == nil || !a.jsonHeader.Replace {
+		for i := range a.headers {
+			a.addField(req.Header, &a.headers[i], record)
+		}
 	}
-	if a.headers.Region != "" {
-		req.Header.Add(a.headers.Region, record.region)
+	a.addStatusHeaders(req, record)
+	a.addJSONHeader(req, record)
+	a.addTemplateHeaders(req, record)
+	a.addStructuredHeader(req, record)
+}
+
+func (a *TraefikGeoIP2) addStatusHeaders(req *http.Request, record *GeoIPResult) {
+	if a.statusHeader != "" {
+		req.Header.Set(a.statusHeader, record.status)
 	}
-	if a.headers.City != "" {
-		req.Header.Add(a.headers.City, record.city)
+	if a.sourceHeader != "" && record.source != "" {
+		req.Header.Set(a.sourceHeader, record.source)
 	}
-	if a.headers.Latitude != "" {
-		req.Header.Add(a.headers.Latitude, record.latitude)
+}
+
+func (a *TraefikGeoIP2) addField(header http.Header, h *fieldHeader, record *GeoIPResult) {
+	value, ok := record.get(h.field)
+	if ok {
+		value = h.apply(value)
 	}
-	if a.headers.Longitude != "" {
-		req.Header.Add(a.headers.Longitude, record.longitude)
+	a.setHeader(header, h.Name, value, ok)
+}
+
+// setHeader writes the header, applying the missing value mode when the field was not found.
+func (a *TraefikGeoIP2) setHeader(header http.Header, name, value string, found bool) {
+	if !found {
+		missing, ok := a.missingHeaders[http.CanonicalHeaderKey(name)]
+		if !ok {
+			missing = a.missing
+		}
+		switch missing.Mode {
+		case MissingOmit:
+			return
+		case MissingEmpty:
+			value = ""
+		default:
+			value = missing.Placeholder
+		}
 	}
+	header.Add(name, value)
 }
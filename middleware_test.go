@@ -2,10 +2,18 @@ package traefikgeoip2_test
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	mw "github.com/prochri/traefikgeoip2"
 )
@@ -16,6 +24,14 @@ const (
 	LocalIP       = "10.0.0.42"
 )
 
+const (
+	CountryHeader   = "Geoip_Country"
+	RegionHeader    = "Geoip_Region"
+	CityHeader      = "Geoip_City"
+	LatitudeHeader  = "Geoip_Latitude"
+	LongitudeHeader = "Geoip_Longitude"
+)
+
 func TestGeoIPConfig(t *testing.T) {
 	mwCfg := mw.CreateConfig()
 	if mw.CreateConfig().DBPath != mwCfg.DBPath {
@@ -85,10 +101,9 @@ func TestMissingGeoIPDB(t *testing.T) {
 		t.Fatalf("next handler was not called")
 	}
 	// TODO: assert no header
-	// hearders := mw.CreateConfig().Headers
-	// assertHeader(t, req, hearders.Country, mw.Unknown)
-	// assertHeader(t, req, hearders.Region, mw.Unknown)
-	// assertHeader(t, req, hearders.City, mw.Unknown)
+	// assertHeader(t, req, CountryHeader, mw.Unknown)
+	// assertHeader(t, req, RegionHeader, mw.Unknown)
+	// assertHeader(t, req, CityHeader, mw.Unknown)
 }
 
 func TestGeoIPFromRemoteAddr(t *testing.T) {
@@ -102,17 +117,16 @@ func TestGeoIPFromRemoteAddr(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
 	req.RemoteAddr = fmt.Sprintf("%s:9999", ValidIP)
 	instance.ServeHTTP(httptest.NewRecorder(), req)
-	hearders := mw.CreateConfig().Headers
-	assertHeader(t, req, hearders.Country, "DE")
-	assertHeader(t, req, hearders.Region, "BY")
-	assertHeader(t, req, hearders.City, "Munich")
+	assertHeader(t, req, CountryHeader, "DE")
+	assertHeader(t, req, RegionHeader, "BY")
+	assertHeader(t, req, CityHeader, "Munich")
 
 	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
 	req.RemoteAddr = "qwerty:9999"
 	instance.ServeHTTP(httptest.NewRecorder(), req)
-	assertHeader(t, req, hearders.Country, mw.Unknown)
-	assertHeader(t, req, hearders.Region, mw.Unknown)
-	assertHeader(t, req, hearders.City, mw.Unknown)
+	assertHeader(t, req, CountryHeader, mw.Unknown)
+	assertHeader(t, req, RegionHeader, mw.Unknown)
+	assertHeader(t, req, CityHeader, mw.Unknown)
 }
 
 func TestGeoIPCountryDBFromRemoteAddr(t *testing.T) {
@@ -127,10 +141,9 @@ func TestGeoIPCountryDBFromRemoteAddr(t *testing.T) {
 	req.RemoteAddr = fmt.Sprintf("%s:9999", ValidIP)
 	instance.ServeHTTP(httptest.NewRecorder(), req)
 
-	hearders := mw.CreateConfig().Headers
-	assertHeader(t, req, hearders.Country, "DE")
-	assertHeader(t, req, hearders.Region, mw.Unknown)
-	assertHeader(t, req, hearders.City, mw.Unknown)
+	assertHeader(t, req, CountryHeader, "DE")
+	assertHeader(t, req, RegionHeader, mw.Unknown)
+	assertHeader(t, req, CityHeader, mw.Unknown)
 }
 
 func TestLocalAddress(t *testing.T) {
@@ -149,10 +162,1610 @@ func TestLocalAddress(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
 	req.RemoteAddr = fmt.Sprintf("%s:9999", LocalIP)
 	instance.ServeHTTP(httptest.NewRecorder(), req)
-	hearders := mw.CreateConfig().Headers
-	assertHeader(t, req, hearders.Country, "DE")
-	assertHeader(t, req, hearders.Region, "BY")
-	assertHeader(t, req, hearders.City, "Munich")
+	assertHeader(t, req, CountryHeader, "DE")
+	assertHeader(t, req, RegionHeader, "BY")
+	assertHeader(t, req, CityHeader, "Munich")
+}
+
+func TestCustomDatabaseFields(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = "./missing"
+	mwCfg.Databases = []mw.Database{{
+		Path: writeTestDB(t, "Internal-Zones", map[string]interface{}{
+			"10.0.0.0/8": map[string]interface{}{
+				"zone":   map[string]interface{}{"owner": "netops"},
+				"traits": map[string]interface{}{"autonomous_system_number": uint32(64512)},
+			},
+		}),
+		Fields: map[string]string{
+			"zone.owner":                      "X-Zone-Owner",
+			"traits.autonomous_system_number": "X-ASN",
+			"zone.missing":                    "X-Zone-Missing",
+		},
+	}}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	instance, _ := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = fmt.Sprintf("%s:9999", LocalIP)
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Zone-Owner", "netops")
+	assertHeader(t, req, "X-ASN", "64512")
+	assertHeader(t, req, "X-Zone-Missing", mw.Unknown)
+
+	mwCfg.Databases[0].Path = "./missing-zones.mmdb"
+	instance, _ = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = fmt.Sprintf("%s:9999", LocalIP)
+	req.Header.Set("X-Zone-Owner", "spoofed")
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	if values := req.Header.Values("X-Zone-Owner"); len(values) != 0 {
+		t.Fatalf("client supplied header of a missing DB must be dropped %v", values)
+	}
+}
+
+func TestMissingFields(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-City", map[string]interface{}{
+		"188.193.0.0/16": map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": "DE"},
+		},
+	})
+	mwCfg.Missing = &mw.Missing{Mode: mw.MissingPlaceholder, Placeholder: "-"}
+	mwCfg.MissingHeaders = map[string]mw.Missing{
+		"geoip_city":     {Mode: mw.MissingOmit},
+		"Geoip_Latitude": {Mode: mw.MissingEmpty},
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	mw.ResetLookup()
+	instance, _ := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = fmt.Sprintf("%s:9999", ValidIP)
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, CountryHeader, "DE")
+	assertHeader(t, req, RegionHeader, "-")
+	assertHeader(t, req, LongitudeHeader, "-")
+	if len(req.Header.Values(CityHeader)) != 0 {
+		t.Fatalf("header [%s] must be omitted", CityHeader)
+	}
+	if v := req.Header.Values(LatitudeHeader); len(v) != 1 || v[0] != "" {
+		t.Fatalf("header [%s] must be empty", LatitudeHeader)
+	}
+}
+
+func TestStatusHeaders(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-City", map[string]interface{}{
+		"188.193.0.0/16": map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": "DE"},
+		},
+	})
+	mwCfg.StatusHeader = "X-Geoip-Status"
+	mwCfg.SourceHeader = "X-Geoip-Source"
+	mwCfg.LocationRewrites = []mw.LocationRewrite{{Name: "office", IpRange: "10.0.0.0/16", Country: "DE"}}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	mw.ResetLookup()
+	instance, _ := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+
+	for _, tc := range []struct {
+		remoteAddr string
+		status     string
+		source     string
+	}{
+		{fmt.Sprintf("%s:9999", ValidIP), mw.StatusOK, "GeoLite2-City"},
+		{"10.0.1.1:9999", mw.StatusRewrite, "office"},
+		{"10.1.0.1:9999", mw.StatusPrivate, ""},
+		{"8.8.8.8:9999", mw.StatusNotFound, ""},
+		{"qwerty:9999", mw.StatusInvalidIP, ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = tc.remoteAddr
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		assertHeader(t, req, mwCfg.StatusHeader, tc.status)
+		assertHeader(t, req, mwCfg.SourceHeader, tc.source)
+	}
+
+	mwCfg.DBPath = "./missing"
+	instance, _ = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, mwCfg.StatusHeader, mw.StatusDBUnavailable)
+}
+
+func TestJSONHeader(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-City", map[string]interface{}{
+		"188.193.0.0/16": map[string]interface{}{
+			"country":      map[string]interface{}{"iso_code": "DE"},
+			"subdivisions": []interface{}{map[string]interface{}{"iso_code": "BY"}},
+		},
+	})
+	mwCfg.JSONHeader = &mw.JSONHeader{Name: "X-Geoip", Replace: true}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	mw.ResetLookup()
+	instance, _ := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = fmt.Sprintf("%s:9999", ValidIP)
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Geoip", `{"country":"DE","eu":"false","region":"BY","source":"GeoLite2-City","status":"ok","subdivisions":"DE-BY"}`)
+	assertHeader(t, req, CountryHeader, "")
+
+	mwCfg.JSONHeader = &mw.JSONHeader{Name: "X-Geoip", Encoding: mw.EncodingBase64URL, Fields: []string{"country", "city"}}
+	instance, _ = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = fmt.Sprintf("%s:9999", ValidIP)
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Geoip", "eyJjb3VudHJ5IjoiREUifQ")
+	assertHeader(t, req, CountryHeader, "DE")
+}
+
+func TestHeaderTemplates(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-City", map[string]interface{}{
+		"188.193.0.0/16": map[string]interface{}{
+			"country":      map[string]interface{}{"iso_code": "DE", "names": map[string]interface{}{"en": "Germany"}},
+			"subdivisions": []interface{}{map[string]interface{}{"iso_code": "BY"}},
+			"city":         map[string]interface{}{"names": map[string]interface{}{"en": "Munich"}},
+		},
+	})
+	mwCfg.HeaderTemplates = map[string]string{
+		"X-Geo-Locale": "{{.Country}}-{{.Region}}",
+		"X-Geo":        "{{.City}}, {{.CountryName}}",
+		"X-Geo-Postal": "{{if .PostalCode}}{{.PostalCode}}{{else}}none{{end}}",
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	mw.ResetLookup()
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = fmt.Sprintf("%s:9999", ValidIP)
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-Geo-Locale", "DE-BY")
+	assertHeader(t, req, "X-Geo", "Munich, Germany")
+	assertHeader(t, req, "X-Geo-Postal", "none")
+
+	for _, text := range []string{"{{.City", "{{.City.Name}}"} {
+		mwCfg.HeaderTemplates = map[string]string{"X-Geo": text}
+		if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+			t.Fatalf("Must fail on invalid template %s", text)
+		}
+	}
+}
+
+func TestHeaderMapping(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-Country", map[string]interface{}{
+		"188.193.0.0/16": map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": "DE", "names": map[string]interface{}{"en": "Germany"}},
+		},
+	})
+	mwCfg.Headers = mw.Headers{
+		"Country": []interface{}{
+			"Geoip_Country",
+			map[string]interface{}{"name": "X-Country-Lower", "transform": mw.TransformLowercase},
+			mw.Header{Name: "X-Country-Alpha3", Transform: mw.TransformAlpha3, Prefix: "[", Suffix: "]"},
+		},
+		mw.FieldCountryName: []string{"X-Country-Name", "X-Legacy-Country-Name"},
+		mw.FieldCity:        mw.Header{Name: "X-City", Transform: mw.TransformUppercase, Prefix: "city:"},
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	mw.ResetLookup()
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = fmt.Sprintf("%s:9999", ValidIP)
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, CountryHeader, "DE")
+	assertHeader(t, req, "X-Country-Lower", "de")
+	assertHeader(t, req, "X-Country-Alpha3", "[DEU]")
+	assertHeader(t, req, "X-Country-Name", "Germany")
+	assertHeader(t, req, "X-Legacy-Country-Name", "Germany")
+	assertHeader(t, req, "X-City", mw.Unknown)
+	assertHeader(t, req, RegionHeader, "")
+
+	mwCfg.Headers = mw.Headers{mw.FieldCity: mw.Header{Name: "X-City", Transform: "reverse"}}
+	if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatalf("Must fail on unknown transform")
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-Country", map[string]interface{}{
+		"188.193.0.0/16": map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": "DE"},
+		},
+	})
+	mwCfg.Headers = mw.Headers{mw.FieldCountry: CountryHeader}
+	mwCfg.ResponseHeaders = mw.Headers{mw.FieldCountry: "X-Country"}
+	mwCfg.Vary = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Country", "FR")
+		rw.Header().Set("Vary", "Accept-Encoding")
+		rw.Header().Set("Cache-Control", "public, max-age=60, s-maxage=600")
+		rw.WriteHeader(http.StatusTeapot)
+	})
+	mw.ResetLookup()
+	instance, _ := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = fmt.Sprintf("%s:9999", ValidIP)
+	instance.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusTeapot {
+		t.Fatalf("Invalid return code %d", recorder.Code)
+	}
+	if recorder.Header().Get("X-Country") != "DE" {
+		t.Fatalf("invalid response header [X-Country] %s", recorder.Header().Get("X-Country"))
+	}
+	if vary := recorder.Header().Values("Vary"); len(vary) != 2 || vary[1] != CountryHeader {
+		t.Fatalf("invalid response header [Vary] %v", vary)
+	}
+	if recorder.Header().Get("Cache-Control") != "private, max-age=60" {
+		t.Fatalf("invalid response header [Cache-Control] %s", recorder.Header().Get("Cache-Control"))
+	}
+
+	instance, _ = mw.New(context.TODO(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), mwCfg, "traefik-geoip2")
+	recorder = httptest.NewRecorder()
+	instance.ServeHTTP(recorder, req)
+	if recorder.Header().Get("X-Country") != "DE" {
+		t.Fatalf("response header must be set when the backend writes nothing")
+	}
+	if recorder.Header().Get("Cache-Control") != "private" {
+		t.Fatalf("invalid response header [Cache-Control] %s", recorder.Header().Get("Cache-Control"))
+	}
+}
+
+func TestGeoCookie(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-City", map[string]interface{}{
+		"188.193.0.0/16": map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": "BR"},
+			"city":    map[string]interface{}{"names": map[string]interface{}{"en": "São Paulo"}},
+		},
+	})
+	mwCfg.Cookie = &mw.Cookie{Name: "geo", MaxAge: 3600, SameSite: "lax", Secure: true, Secret: "s3cr3t"}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	mw.ResetLookup()
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = fmt.Sprintf("%s:9999", ValidIP)
+	instance.ServeHTTP(recorder, req)
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge != 3600 || !cookies[0].Secure || cookies[0].SameSite != http.SameSiteLaxMode {
+		t.Fatalf("invalid cookie %v", cookies)
+	}
+	fields, err := mw.VerifyCookie(cookies[0].Value, "s3cr3t", time.Hour)
+	if err != nil || len(fields) != 3 || fields[0] != "BR" || fields[1] != "" || fields[2] != "São Paulo" {
+		t.Fatalf("invalid cookie fields %v: %v", fields, err)
+	}
+	if _, err = mw.VerifyCookie(cookies[0].Value, "other", time.Hour); err == nil {
+		t.Fatalf("Must fail on invalid signature")
+	}
+
+	recorder = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = fmt.Sprintf("%s:9999", ValidIP)
+	req.AddCookie(cookies[0])
+	instance.ServeHTTP(recorder, req)
+	if len(recorder.Result().Cookies()) != 0 {
+		t.Fatalf("up to date cookie must not be set again")
+	}
+
+	// issued two hours ago, past half of maxAge
+	stale := fmt.Sprintf("BR||S%%C3%%A3o%%20Paulo|%d", time.Now().Add(-2*time.Hour).Unix())
+	mac := hmac.New(sha256.New, []byte("s3cr3t"))
+	mac.Write([]byte(stale))
+	stale += "|" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if _, err = mw.VerifyCookie(stale, "s3cr3t", time.Hour); err == nil {
+		t.Fatalf("Must fail on expired cookie")
+	}
+	if _, err = mw.VerifyCookie(stale, "s3cr3t", 0); err != nil {
+		t.Fatalf("Error verifying without maxAge %v", err)
+	}
+	recorder = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = fmt.Sprintf("%s:9999", ValidIP)
+	req.AddCookie(&http.Cookie{Name: "geo", Value: stale})
+	instance.ServeHTTP(recorder, req)
+	if len(recorder.Result().Cookies()) != 1 {
+		t.Fatalf("stale cookie must be renewed")
+	}
+
+	mwCfg.Cookie.SameSite = "sometimes"
+	if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatalf("Must fail on invalid SameSite")
+	}
+}
+
+func TestSignedHeaders(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-Country", map[string]interface{}{
+		"188.193.0.0/16": map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": "DE"},
+		},
+	})
+	mwCfg.Signature = &mw.Signature{Header: "X-Geoip-Signature", Secret: "s3cr3t"}
+
+	var backend http.Header
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { backend = req.Header })
+	mw.ResetLookup()
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = fmt.Sprintf("%s:9999", ValidIP)
+	req.Header.Set(CountryHeader, "US")
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	if values := backend.Values(CountryHeader); len(values) != 1 || values[0] != "DE" {
+		t.Fatalf("client supplied header must be dropped %v", values)
+	}
+
+	verifier := mw.SignatureVerifier{Header: "X-Geoip-Signature", Secret: "s3cr3t", MaxAge: time.Minute}
+	if err = verifier.Verify(backend, ValidIP); err != nil {
+		t.Fatalf("Error verifying %v", err)
+	}
+	if err = verifier.Verify(backend, LocalIP); err == nil {
+		t.Fatalf("Must fail for another client IP")
+	}
+	backend.Set(CountryHeader, "US")
+	if err = verifier.Verify(backend, ValidIP); err == nil {
+		t.Fatalf("Must fail on tampered header")
+	}
+
+	mwCfg.Signature.Secret = ""
+	if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatalf("Must fail on empty secret")
+	}
+}
+
+func TestStructuredHeader(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-City", map[string]interface{}{
+		"188.193.0.0/16": map[string]interface{}{
+			"country":      map[string]interface{}{"iso_code": "DE", "is_in_european_union": true},
+			"subdivisions": []interface{}{map[string]interface{}{"iso_code": "BY"}},
+			"city":         map[string]interface{}{"names": map[string]interface{}{"en": "München"}},
+			"location":     map[string]interface{}{"latitude": 48.1351, "longitude": 11.582, "accuracy_radius": uint16(20)},
+		},
+	})
+	mwCfg.Headers[mw.FieldEU] = "X-Geo-EU"
+	mwCfg.Headers[mw.FieldAccuracy] = "X-Geo-Accuracy"
+	mwCfg.Headers[mw.FieldCountryName] = "X-Geo-Country-Name"
+	mwCfg.Headers[mw.FieldASN] = "X-Geo-ASN"
+	mwCfg.ASNDBPath = writeTestDB(t, "GeoLite2-ASN", map[string]interface{}{
+		"188.193.0.0/16": map[string]interface{}{"autonomous_system_number": uint32(3209)},
+	})
+	mwCfg.StructuredHeader = "Geo"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	mw.ResetLookup()
+	instance, _ := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = fmt.Sprintf("%s:9999", ValidIP)
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "Geo", `accuracy_radius=20, asn=3209, city="Munchen", country="DE", eu, latitude=48.135, longitude=11.582, region="BY"`)
+}
+
+func TestHeaderEncoding(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-City", map[string]interface{}{
+		"188.193.0.0/16": map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": "DE"},
+			"city":    map[string]interface{}{"names": map[string]interface{}{"en": "Zürich Straße"}},
+		},
+	})
+	mwCfg.Headers = mw.Headers{
+		mw.FieldCity: []mw.Header{
+			{Name: "X-City-Raw", Encoding: mw.EncodingRaw},
+			{Name: "X-City-ASCII", Encoding: mw.EncodingASCII},
+			{Name: "X-City-Percent", Encoding: mw.EncodingPercent},
+			{Name: "X-City-Ext", Encoding: mw.EncodingRFC8187},
+			{Name: "X-City-B64", Encoding: mw.EncodingBase64},
+		},
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	mw.ResetLookup()
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = fmt.Sprintf("%s:9999", ValidIP)
+	instance.ServeHTTP(httptest.NewRecorder(), req)
+	assertHeader(t, req, "X-City-Raw", "Zürich Straße")
+	assertHeader(t, req, "X-City-ASCII", "Zurich Strasse")
+	assertHeader(t, req, "X-City-Percent", "Z%C3%BCrich%20Stra%C3%9Fe")
+	assertHeader(t, req, "X-City-Ext", "UTF-8''Z%C3%BCrich%20Stra%C3%9Fe")
+	assertHeader(t, req, "X-City-B64", "WsO8cmljaCBTdHJhw59l")
+
+	mwCfg.Headers = mw.Headers{mw.FieldCity: mw.Header{Name: "X-City", Encoding: "rot13"}}
+	if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatalf("Must fail on unknown encoding")
+	}
+}
+
+func TestCountryBlocking(t *testing.T) {
+	dbPath := writeTestDB(t, "GeoLite2-Country", map[string]interface{}{
+		"188.193.0.0/16": map[string]interface{}{"country": map[string]interface{}{"iso_code": "DE"}},
+		"5.3.0.0/16":     map[string]interface{}{"country": map[string]interface{}{"iso_code": "RU"}},
+		"8.8.0.0/16":     map[string]interface{}{"continent": map[string]interface{}{"code": "NA"}},
+	})
+	mw.ResetLookup()
+
+	for _, tc := range []struct {
+		name       string
+		cfg        func(*mw.Config)
+		remoteAddr string
+		code       int
+	}{
+		{"denied country", func(c *mw.Config) { c.DenyCountries = []string{"ru"} }, "5.3.0.1:9999", http.StatusForbidden},
+		{"not denied country", func(c *mw.Config) { c.DenyCountries = []string{"RU"} }, "188.193.0.1:9999", http.StatusOK},
+		{"allowed country", func(c *mw.Config) { c.AllowCountries = []string{"DE"} }, "188.193.0.1:9999", http.StatusOK},
+		{"not allowed country", func(c *mw.Config) { c.AllowCountries = []string{"DE"} }, "5.3.0.1:9999", http.StatusForbidden},
+		{"unknown country denied", func(c *mw.Config) { c.UnknownCountry = mw.ActionDeny }, "8.8.0.1:9999", http.StatusForbidden},
+		{"unknown country passed", func(c *mw.Config) {
+			c.DenyCountries = []string{"RU"}
+			c.UnknownCountry = mw.ActionPass
+		}, "8.8.0.1:9999", http.StatusOK},
+		{"unknown country passed despite allowlist", func(c *mw.Config) {
+			c.AllowCountries = []string{"DE"}
+			c.UnknownCountry = mw.ActionPass
+		}, "8.8.0.1:9999", http.StatusOK},
+		{"unknown country left to allowlist", func(c *mw.Config) { c.AllowCountries = []string{"DE"} }, "8.8.0.1:9999", http.StatusForbidden},
+		{"private ip passed despite allowlist", func(c *mw.Config) {
+			c.AllowCountries = []string{"DE"}
+			c.PrivateIP = mw.ActionPass
+		}, "10.0.0.1:9999", http.StatusOK},
+		{"private ip allowed", func(c *mw.Config) {
+			c.AllowCountries = []string{"DE"}
+			c.UnknownCountry = mw.ActionDeny
+			c.PrivateIP = mw.ActionAllow
+		}, "10.0.0.1:9999", http.StatusOK},
+		{"private ip denied", func(c *mw.Config) { c.PrivateIP = mw.ActionDeny }, "10.0.0.1:9999", http.StatusForbidden},
+	} {
+		mwCfg := mw.CreateConfig()
+		mwCfg.DBPath = dbPath
+		tc.cfg(mwCfg)
+
+		called := false
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { called = true })
+		instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+		if err != nil {
+			t.Fatalf("%s: Error creating %v", tc.name, err)
+		}
+
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = tc.remoteAddr
+		instance.ServeHTTP(recorder, req)
+		if recorder.Code != tc.code || called != (tc.code == http.StatusOK) {
+			t.Fatalf("%s: invalid return code %d, next called: %v", tc.name, recorder.Code, called)
+		}
+	}
+
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = dbPath
+	mwCfg.DenyCountries = []string{"RU"}
+	mwCfg.Block = &mw.BlockResponse{StatusCode: http.StatusUnavailableForLegalReasons, Body: "blocked", BlockedBy: "https://example.com/legal"}
+	instance, _ := mw.New(context.TODO(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), mwCfg, "traefik-geoip2")
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "5.3.0.1:9999"
+	instance.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusUnavailableForLegalReasons || recorder.Body.String() != "blocked" ||
+		recorder.Header().Get("Link") != `<https://example.com/legal>; rel="blocked-by"` {
+		t.Fatalf("invalid block response %d %s %v", recorder.Code, recorder.Body.String(), recorder.Header())
+	}
+}
+
+func TestSubdivisionBlocking(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-City", map[string]interface{}{
+		"5.3.0.0/16": map[string]interface{}{
+			"country":      map[string]interface{}{"iso_code": "UA"},
+			"subdivisions": []interface{}{map[string]interface{}{"iso_code": "43"}},
+		},
+		"5.4.0.0/16": map[string]interface{}{
+			"country":      map[string]interface{}{"iso_code": "UA"},
+			"subdivisions": []interface{}{map[string]interface{}{"iso_code": "30"}},
+		},
+		"5.5.0.0/16": map[string]interface{}{
+			"country":      map[string]interface{}{"iso_code": "UA"},
+			"subdivisions": []interface{}{map[string]interface{}{"iso_code": "46"}},
+		},
+		"5.6.0.0/16": map[string]interface{}{"country": map[string]interface{}{"iso_code": "IR"}},
+	})
+	mwCfg.Presets = []string{mw.PresetEmbargo}
+	mwCfg.DenySubdivisions = []string{"ua-46"}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	mw.ResetLookup()
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	for remoteAddr, code := range map[string]int{
+		"5.3.0.1:9999": http.StatusForbidden,
+		"5.4.0.1:9999": http.StatusOK,
+		"5.5.0.1:9999": http.StatusForbidden,
+		"5.6.0.1:9999": http.StatusForbidden,
+	} {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = remoteAddr
+		instance.ServeHTTP(recorder, req)
+		if recorder.Code != code {
+			t.Fatalf("invalid return code for %s: %d", remoteAddr, recorder.Code)
+		}
+	}
+
+	mwCfg.DenySubdivisions = nil
+	mwCfg.PresetOverrides = map[string]mw.Preset{mw.PresetEmbargo: {Subdivisions: []string{"UA-30"}}}
+	instance, _ = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	for remoteAddr, code := range map[string]int{
+		"5.3.0.1:9999": http.StatusOK,
+		"5.4.0.1:9999": http.StatusForbidden,
+		"5.6.0.1:9999": http.StatusOK,
+	} {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = remoteAddr
+		instance.ServeHTTP(recorder, req)
+		if recorder.Code != code {
+			t.Fatalf("invalid return code for %s with overridden preset: %d", remoteAddr, recorder.Code)
+		}
+	}
+
+	mwCfg.Presets = []string{"unknown"}
+	if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatalf("Must fail on unknown preset")
+	}
+}
+
+func TestASNBlocking(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-City", map[string]interface{}{
+		"5.0.0.0/8": map[string]interface{}{"country": map[string]interface{}{"iso_code": "RU"}},
+		"6.0.0.0/8": map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": "DE"},
+			"traits":  map[string]interface{}{"autonomous_system_number": uint32(64600)},
+		},
+	})
+	mwCfg.ASNDBPath = writeTestDB(t, "GeoLite2-ASN", map[string]interface{}{
+		"5.1.0.0/16": map[string]interface{}{
+			"autonomous_system_number":       uint32(13335),
+			"autonomous_system_organization": "Monitoring Inc",
+		},
+		"5.2.0.0/16": map[string]interface{}{
+			"autonomous_system_number":       uint32(64512),
+			"autonomous_system_organization": "Cheap Hosting",
+		},
+		"5.3.0.0/16": map[string]interface{}{
+			"autonomous_system_number":       uint32(1000),
+			"autonomous_system_organization": "Bulletproof VPS Ltd",
+		},
+	})
+	mwCfg.DenyCountries = []string{"RU"}
+	mwCfg.AllowASNs = []string{"AS13335"}
+	mwCfg.DenyASNs = []string{"64512-65534"}
+	mwCfg.DenyASOrgs = []string{"(?i)bulletproof"}
+	mwCfg.Headers = mw.Headers{mw.FieldASN: "X-ASN", mw.FieldASOrg: "X-AS-Org"}
+
+	var asn string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		asn = req.Header.Get("X-ASN")
+	})
+	mw.ResetLookup()
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	for remoteAddr, code := range map[string]int{
+		"5.1.0.1:9999": http.StatusOK,
+		"5.2.0.1:9999": http.StatusForbidden,
+		"5.3.0.1:9999": http.StatusForbidden,
+		"5.4.0.1:9999": http.StatusForbidden,
+		"6.0.0.1:9999": http.StatusForbidden,
+	} {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = remoteAddr
+		instance.ServeHTTP(recorder, req)
+		if recorder.Code != code {
+			t.Fatalf("invalid return code for %s: %d", remoteAddr, recorder.Code)
+		}
+	}
+	if asn != "13335" {
+		t.Fatalf("invalid value of header [X-ASN] %s", asn)
+	}
+
+	// another instance with its own ASN DB, the reader of the first one must not be reused
+	other := *mwCfg
+	other.DenyCountries = nil
+	other.ASNDBPath = writeTestDB(t, "GeoLite2-ASN", map[string]interface{}{
+		"5.1.0.0/16": map[string]interface{}{"autonomous_system_number": uint32(3320)},
+	})
+	otherInstance, err := mw.New(context.TODO(), next, &other, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "5.1.0.1:9999"
+	otherInstance.ServeHTTP(httptest.NewRecorder(), req)
+	if asn != "3320" {
+		t.Fatalf("invalid value of header [X-ASN] from second DB %s", asn)
+	}
+
+	for _, numbers := range [][]string{{"AS"}, {"200-100"}, {"4294967296"}} {
+		mwCfg.DenyASNs = numbers
+		if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+			t.Fatalf("Must fail on invalid ASN rule %v", numbers)
+		}
+	}
+	mwCfg.DenyASNs = nil
+	mwCfg.DenyASOrgs = []string{"("}
+	if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatalf("Must fail on invalid AS organization pattern")
+	}
+}
+
+func TestAnonymizers(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-Country", map[string]interface{}{
+		"5.0.0.0/8": map[string]interface{}{"country": map[string]interface{}{"iso_code": "DE"}},
+	})
+	mwCfg.AnonymousIPDBPath = writeTestDB(t, "GeoIP2-Anonymous-IP", map[string]interface{}{
+		"5.1.0.0/16": map[string]interface{}{"is_anonymous": true, "is_tor_exit_node": true},
+		"5.2.0.0/16": map[string]interface{}{"is_anonymous": true, "is_anonymous_vpn": true},
+		"5.3.0.0/16": map[string]interface{}{"is_anonymous": true, "is_hosting_provider": true},
+		"5.4.0.0/16": map[string]interface{}{"is_anonymous": true, "is_public_proxy": true},
+	})
+	mwCfg.Anonymizers = &mw.Anonymizers{
+		TorExitNode:     mw.ActionDeny,
+		AnonymousVPN:    mw.ActionRedirect,
+		HostingProvider: mw.ActionTag,
+		PublicProxy:     mw.ActionAllow,
+		RedirectURL:     "https://example.com/challenge",
+	}
+	mwCfg.Headers = mw.Headers{mw.FieldAnonymizer: "X-Anonymizer"}
+
+	var tag string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		tag = req.Header.Get("X-Anonymizer")
+	})
+	mw.ResetLookup()
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	for _, tc := range []struct {
+		remoteAddr string
+		url        string
+		code       int
+		tag        string
+	}{
+		{"5.1.0.1:9999", "http://localhost/login", http.StatusForbidden, ""},
+		{"5.2.0.1:9999", "http://localhost/login", http.StatusFound, ""},
+		{"5.2.0.1:9999", "https://example.com/challenge", http.StatusOK, mw.Unknown},
+		{"5.3.0.1:9999", "http://localhost/login", http.StatusOK, mw.FlagHostingProvider},
+		{"5.4.0.1:9999", "http://localhost/login", http.StatusOK, mw.Unknown},
+		{"5.5.0.1:9999", "http://localhost/login", http.StatusOK, mw.Unknown},
+	} {
+		tag = ""
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		req.RemoteAddr = tc.remoteAddr
+		instance.ServeHTTP(recorder, req)
+		if recorder.Code != tc.code || tag != tc.tag {
+			t.Fatalf("invalid response for %s %s: %d, tag %q", tc.remoteAddr, tc.url, recorder.Code, tag)
+		}
+		if tc.code == http.StatusFound && recorder.Header().Get("Location") != mwCfg.Anonymizers.RedirectURL {
+			t.Fatalf("invalid redirect location %s", recorder.Header().Get("Location"))
+		}
+	}
+
+	// another instance with its own Anonymous-IP DB, the reader of the first one must not be reused
+	other := *mwCfg
+	other.AnonymousIPDBPath = writeTestDB(t, "GeoIP2-Anonymous-IP", map[string]interface{}{
+		"5.1.0.0/16": map[string]interface{}{"is_anonymous": true, "is_hosting_provider": true},
+	})
+	otherInstance, err := mw.New(context.TODO(), next, &other, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+	tag = ""
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/login", nil)
+	req.RemoteAddr = "5.1.0.1:9999"
+	otherInstance.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK || tag != mw.FlagHostingProvider {
+		t.Fatalf("invalid response from second DB: %d, tag %q", recorder.Code, tag)
+	}
+
+	mwCfg.Anonymizers = &mw.Anonymizers{AnonymousVPN: mw.ActionRedirect}
+	if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatalf("Must fail on redirect without URL")
+	}
+	mwCfg.Anonymizers = &mw.Anonymizers{TorExitNode: "challenge"}
+	if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatalf("Must fail on invalid action")
+	}
+}
+
+func TestGeofences(t *testing.T) {
+	location := func(lat, lon float64, accuracy uint16) map[string]interface{} {
+		return map[string]interface{}{
+			"country":  map[string]interface{}{"iso_code": "DE"},
+			"location": map[string]interface{}{"latitude": lat, "longitude": lon, "accuracy_radius": accuracy},
+		}
+	}
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-City", map[string]interface{}{
+		"5.1.0.0/16": location(52.52, 13.405, 20),
+		"5.2.0.0/16": location(48.137, 11.575, 200),
+		"5.3.0.0/16": location(48.137, 11.575, 50),
+		"5.4.0.0/16": location(48.857, 2.352, 10),
+		"5.5.0.0/16": map[string]interface{}{"country": map[string]interface{}{"iso_code": "DE"}},
+	})
+	dir := t.TempDir()
+	bavaria := filepath.Join(dir, "bavaria.geojson")
+	germany := filepath.Join(dir, "germany.geojson")
+	for path, data := range map[string]string{
+		bavaria: `{"type":"FeatureCollection","features":[{"type":"Feature","properties":{},` +
+			`"geometry":{"type":"MultiPolygon","coordinates":[[[[9,47],[14,47],[14,50.5],[9,50.5],[9,47]]]]}}]}`,
+		germany: `{"type":"Polygon","coordinates":[[[5,47],[15,47],[15,55],[5,55],[5,47]],` +
+			`[[11,48],[12,48],[12,48.3],[11,48.3],[11,48]]]}`,
+	} {
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatalf("unable to write GeoJSON: %v", err)
+		}
+	}
+	mwCfg.Geofences = []mw.Geofence{
+		{Name: "berlin", Latitude: 52.5, Longitude: 13.4, RadiusKm: 50, Action: mw.ActionAllow},
+		{Name: "bavaria", GeoJSON: bavaria, MaxAccuracyRadius: 100, Action: mw.ActionAllow},
+		{Name: "germany", GeoJSON: germany},
+	}
+	mwCfg.Headers = mw.Headers{mw.FieldGeofence: "X-Geo-Fence"}
+
+	var fence string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fence = req.Header.Get("X-Geo-Fence")
+	})
+	mw.ResetLookup()
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	serve := func(remoteAddr string) int {
+		fence = ""
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = remoteAddr
+		instance.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+	for _, tc := range []struct {
+		remoteAddr string
+		code       int
+		fence      string
+	}{
+		{"5.1.0.1:9999", http.StatusOK, "berlin,germany"},
+		{"5.2.0.1:9999", http.StatusForbidden, ""},
+		{"5.3.0.1:9999", http.StatusOK, "bavaria"},
+		{"5.4.0.1:9999", http.StatusForbidden, ""},
+		{"5.5.0.1:9999", http.StatusForbidden, ""},
+	} {
+		if code := serve(tc.remoteAddr); code != tc.code || fence != tc.fence {
+			t.Fatalf("invalid response for %s: %d, fence %q", tc.remoteAddr, code, fence)
+		}
+	}
+
+	mwCfg.Geofences = []mw.Geofence{{Name: "paris", Latitude: 48.86, Longitude: 2.35, RadiusKm: 30, Action: mw.ActionDeny}}
+	instance, _ = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if code := serve("5.4.0.1:9999"); code != http.StatusForbidden {
+		t.Fatalf("invalid return code inside deny fence: %d", code)
+	}
+	if code := serve("5.1.0.1:9999"); code != http.StatusOK || fence != mw.Unknown {
+		t.Fatalf("invalid response outside deny fence: %d, fence %q", code, fence)
+	}
+
+	for _, fences := range [][]mw.Geofence{
+		{{Name: "no-area", Latitude: 1, Longitude: 1}},
+		{{Name: "missing", GeoJSON: filepath.Join(dir, "missing.geojson")}},
+		{{Name: "a", RadiusKm: 1}, {Name: "a", RadiusKm: 1}},
+		{{Name: "b", RadiusKm: 1, Action: "tag"}},
+	} {
+		mwCfg.Geofences = fences
+		if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+			t.Fatalf("Must fail on invalid geofences %v", fences)
+		}
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-City", map[string]interface{}{
+		"5.1.0.0/16": map[string]interface{}{
+			"continent": map[string]interface{}{"code": "EU"},
+			"country":   map[string]interface{}{"iso_code": "DE"},
+		},
+		"5.2.0.0/16": map[string]interface{}{
+			"continent": map[string]interface{}{"code": "EU"},
+			"country":   map[string]interface{}{"iso_code": "FR"},
+		},
+		"5.3.0.0/16": map[string]interface{}{
+			"continent":    map[string]interface{}{"code": "NA"},
+			"country":      map[string]interface{}{"iso_code": "US"},
+			"subdivisions": []interface{}{map[string]interface{}{"iso_code": "CA"}},
+		},
+		"5.4.0.0/16": map[string]interface{}{
+			"continent": map[string]interface{}{"code": "EU"},
+			"country":   map[string]interface{}{"iso_code": "IT"},
+		},
+		"5.5.0.0/16": map[string]interface{}{
+			"continent": map[string]interface{}{"code": "NA"},
+			"country":   map[string]interface{}{"iso_code": "US"},
+		},
+	})
+	mwCfg.Redirects = &mw.Redirects{
+		Rules: []mw.Redirect{
+			{Continent: "EU", Target: "https://example.eu"},
+			{Country: "DE", Target: "https://example.de", StatusCode: http.StatusMovedPermanently},
+			{Country: "FR", Target: "https://example.fr/"},
+			{Subdivision: "US-CA", Target: "/en-us/"},
+		},
+		OptOutCookie: "geo_stay",
+		OptOutQuery:  "stay",
+		ExcludePaths: []string{"/api/"},
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	mw.ResetLookup()
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		url        string
+		prepare    func(*http.Request)
+		code       int
+		location   string
+	}{
+		{"country", "5.1.0.1:9999", "http://example.com/shop?item=1", nil, http.StatusMovedPermanently, "https://example.de/shop?item=1"},
+		{"country over continent", "5.2.0.1:9999", "http://example.com/", nil, http.StatusFound, "https://example.fr/"},
+		{"subdivision path prefix", "5.3.0.1:9999", "http://example.com/shop?a=b", nil, http.StatusFound, "/en-us/shop?a=b"},
+		{"already on prefix", "5.3.0.1:9999", "http://example.com/en-us/shop", nil, http.StatusOK, ""},
+		{"continent", "5.4.0.1:9999", "http://example.com/shop", nil, http.StatusFound, "https://example.eu/shop"},
+		{"already on target", "5.1.0.1:9999", "http://example.de/shop", nil, http.StatusOK, ""},
+		{"no rule", "5.5.0.1:9999", "http://example.com/shop", nil, http.StatusOK, ""},
+		{"excluded path", "5.1.0.1:9999", "http://example.com/api/v1", nil, http.StatusOK, ""},
+		{"opt-out query", "5.1.0.1:9999", "http://example.com/shop?stay", nil, http.StatusOK, ""},
+		{"opt-out cookie", "5.1.0.1:9999", "http://example.com/shop", func(req *http.Request) {
+			req.AddCookie(&http.Cookie{Name: "geo_stay", Value: "1"})
+		}, http.StatusOK, ""},
+		{"bot", "5.1.0.1:9999", "http://example.com/shop", func(req *http.Request) {
+			req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Googlebot/2.1)")
+		}, http.StatusOK, ""},
+		{"post", "5.1.0.1:9999", "http://example.com/shop", func(req *http.Request) {
+			req.Method = http.MethodPost
+		}, http.StatusOK, ""},
+	} {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.prepare != nil {
+			tc.prepare(req)
+		}
+		instance.ServeHTTP(recorder, req)
+		if recorder.Code != tc.code || recorder.Header().Get("Location") != tc.location {
+			t.Fatalf("%s: invalid response %d, location %q", tc.name, recorder.Code, recorder.Header().Get("Location"))
+		}
+		if tc.location != "" && recorder.Header().Get("Cache-Control") != "private, no-store" {
+			t.Fatalf("%s: cacheable redirect %q", tc.name, recorder.Header().Get("Cache-Control"))
+		}
+		if tc.name == "opt-out query" && !strings.HasPrefix(recorder.Header().Get("Set-Cookie"), "geo_stay=1") {
+			t.Fatalf("%s: opt-out cookie not set: %q", tc.name, recorder.Header().Get("Set-Cookie"))
+		}
+	}
+
+	for _, rule := range []mw.Redirect{
+		{Target: "https://example.de"},
+		{Country: "DE", Target: "example.de"},
+		{Country: "DE", Target: "/de/", StatusCode: http.StatusOK},
+	} {
+		mwCfg.Redirects = &mw.Redirects{Rules: []mw.Redirect{rule}}
+		if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+			t.Fatalf("Must fail on invalid redirect %v", rule)
+		}
+	}
+}
+
+func TestLocaleRewrite(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-Country", map[string]interface{}{
+		"5.1.0.0/16": map[string]interface{}{"country": map[string]interface{}{"iso_code": "DE"}},
+		"5.2.0.0/16": map[string]interface{}{"country": map[string]interface{}{"iso_code": "CH"}},
+		"5.3.0.0/16": map[string]interface{}{"country": map[string]interface{}{"iso_code": "JP"}},
+	})
+	mwCfg.LocaleRewrite = &mw.LocaleRewrite{
+		Countries:    map[string]string{"DE": "de", "AT": "de", "CH": "de,fr,it"},
+		Default:      "en",
+		ExcludePaths: []string{"/api/"},
+	}
+
+	var path, requestURI string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		path, requestURI = req.URL.Path, req.RequestURI
+	})
+	mw.ResetLookup()
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	for _, tc := range []struct {
+		remoteAddr     string
+		url            string
+		acceptLanguage string
+		path           string
+	}{
+		{"5.1.0.1:9999", "/products", "", "/de/products"},
+		{"5.2.0.1:9999", "/products", "", "/de/products"},
+		{"5.2.0.1:9999", "/products", "en-US,fr-CH;q=0.9,de;q=0.8", "/fr/products"},
+		{"5.2.0.1:9999", "/products", "it-IT;q=0.5,fr;q=0", "/it/products"},
+		{"5.3.0.1:9999", "/products", "ja", "/en/products"},
+		{"5.1.0.1:9999", "/de/products", "", "/de/products"},
+		{"5.1.0.1:9999", "/EN/products", "", "/EN/products"},
+		{"5.1.0.1:9999", "/static/app.css", "", "/static/app.css"},
+		{"5.1.0.1:9999", "/api/v1/products", "", "/api/v1/products"},
+		{"5.1.0.1:9999", "/", "", "/de/"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+tc.url+"?q=1", nil)
+		req.RemoteAddr = tc.remoteAddr
+		req.Header.Set("Accept-Language", tc.acceptLanguage)
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		if path != tc.path || !strings.HasSuffix(requestURI, tc.path+"?q=1") {
+			t.Fatalf("invalid path for %s %s: %s (%s)", tc.remoteAddr, tc.url, path, requestURI)
+		}
+	}
+
+	mwCfg.LocaleRewrite = &mw.LocaleRewrite{Countries: map[string]string{"DE": "de/at"}}
+	if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatalf("Must fail on invalid locale")
+	}
+}
+
+func TestBlockTemplates(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"block.html":  `<h1>{{.StatusText}}</h1><p>{{.CountryName}}</p><small>{{.RequestID}}</small>`,
+		"block.json":  `{"error":{{json .Reason}},"request_id":{{json .RequestID}}}`,
+		"broken.txt":  `{{.Country`,
+		"failing.txt": `{{index .Country 5}}`,
+	}
+	for name, text := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0o600); err != nil {
+			t.Fatalf("unable to write template: %v", err)
+		}
+	}
+
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-Country", map[string]interface{}{
+		"5.3.0.0/16": map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": "RU", "names": map[string]interface{}{"en": "<Russia>"}},
+		},
+	})
+	mwCfg.DenyCountries = []string{"RU"}
+	mwCfg.Block = &mw.BlockResponse{
+		Body:         "blocked",
+		HTMLTemplate: filepath.Join(dir, "block.html"),
+		JSONTemplate: filepath.Join(dir, "block.json"),
+		RetryAfter:   3600,
+		Headers:      map[string]string{"Cache-Control": "no-store"},
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	mw.ResetLookup()
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	for _, tc := range []struct {
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"text/html,application/xhtml+xml,*/*;q=0.8", "text/html; charset=utf-8",
+			"<h1>Forbidden</h1><p>&lt;Russia&gt;</p><small>req-&#34;1</small>"},
+		{"application/json", "application/json; charset=utf-8", `{"error":"country:RU","request_id":"req-\"1"}`},
+		{"*/*", "text/plain; charset=utf-8", "blocked"},
+		{"", "text/plain; charset=utf-8", "blocked"},
+		{"text/*, application/json;q=0.5", "text/plain; charset=utf-8", "blocked"},
+		{"text/html;q=0.1, text/plain;q=0", "text/html; charset=utf-8",
+			"<h1>Forbidden</h1><p>&lt;Russia&gt;</p><small>req-&#34;1</small>"},
+		{"image/png", "text/plain; charset=utf-8", "blocked"},
+	} {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = "5.3.0.1:9999"
+		req.Header.Set("Accept", tc.accept)
+		req.Header.Set("X-Request-Id", `req-"1`)
+		instance.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusForbidden || recorder.Header().Get("Content-Type") != tc.contentType ||
+			recorder.Body.String() != tc.body {
+			t.Fatalf("invalid response for Accept %q: %d %s %s",
+				tc.accept, recorder.Code, recorder.Header().Get("Content-Type"), recorder.Body.String())
+		}
+		if recorder.Header().Get("Retry-After") != "3600" || recorder.Header().Get("Cache-Control") != "no-store" {
+			t.Fatalf("missing headers for Accept %q: %v", tc.accept, recorder.Header())
+		}
+	}
+
+	for _, block := range []*mw.BlockResponse{
+		{TextTemplate: filepath.Join(dir, "missing.txt")},
+		{TextTemplate: filepath.Join(dir, "broken.txt")},
+		{TextTemplate: filepath.Join(dir, "failing.txt")},
+		{RetryAfter: -1},
+	} {
+		mwCfg.Block = block
+		if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+			t.Fatalf("Must fail on invalid block response %v", block)
+		}
+	}
+}
+
+func TestScopedRules(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-Country", map[string]interface{}{
+		"5.1.0.0/16": map[string]interface{}{
+			"continent": map[string]interface{}{"code": "EU"},
+			"country":   map[string]interface{}{"iso_code": "DE"},
+		},
+		"5.2.0.0/16": map[string]interface{}{
+			"continent": map[string]interface{}{"code": "NA"},
+			"country":   map[string]interface{}{"iso_code": "US"},
+		},
+		"5.3.0.0/16": map[string]interface{}{
+			"continent": map[string]interface{}{"code": "AS"},
+			"country":   map[string]interface{}{"iso_code": "KP"},
+		},
+	})
+	mwCfg.DenyCountries = []string{"KP"}
+	mwCfg.Rules = []mw.Rule{
+		{Name: "webhooks", PathPrefixes: []string{"/webhooks/"}, Methods: []string{"post"}, Action: mw.ActionAllow},
+		{Name: "admin-eu", Hosts: []string{"admin.*"}, Continents: []string{"EU"}, Action: mw.ActionTag},
+		{Name: "admin", Hosts: []string{"admin.*"}, Action: mw.ActionDeny},
+		{Name: "reports", PathRegex: `^/reports/\d+$`, Countries: []string{"US"}, Action: mw.ActionTag},
+	}
+	mwCfg.Headers = mw.Headers{mw.FieldRule: "X-Geo-Rule"}
+
+	var rule string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rule = req.Header.Get("X-Geo-Rule")
+	})
+	mw.ResetLookup()
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	for _, tc := range []struct {
+		method     string
+		url        string
+		remoteAddr string
+		code       int
+		rule       string
+	}{
+		{http.MethodGet, "http://admin.example.com:8443/users", "5.1.0.1:9999", http.StatusOK, "admin-eu"},
+		{http.MethodGet, "http://admin.example.com/users", "5.2.0.1:9999", http.StatusForbidden, ""},
+		{http.MethodGet, "http://www.example.com/users", "5.2.0.1:9999", http.StatusOK, mw.Unknown},
+		{http.MethodGet, "http://www.example.com/reports/42", "5.2.0.1:9999", http.StatusOK, "reports"},
+		{http.MethodGet, "http://www.example.com/reports/42", "5.1.0.1:9999", http.StatusOK, mw.Unknown},
+		{http.MethodPost, "http://www.example.com/webhooks/stripe", "5.3.0.1:9999", http.StatusOK, "webhooks"},
+		{http.MethodGet, "http://www.example.com/webhooks/stripe", "5.3.0.1:9999", http.StatusForbidden, ""},
+		{http.MethodGet, "http://www.example.com/", "5.3.0.1:9999", http.StatusForbidden, ""},
+	} {
+		rule = ""
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(tc.method, tc.url, nil)
+		req.RemoteAddr = tc.remoteAddr
+		instance.ServeHTTP(recorder, req)
+		if recorder.Code != tc.code || rule != tc.rule {
+			t.Fatalf("invalid response for %s %s from %s: %d, rule %q", tc.method, tc.url, tc.remoteAddr, recorder.Code, rule)
+		}
+	}
+
+	for _, rules := range [][]mw.Rule{
+		{{Hosts: []string{"admin.*"}}},
+		{{PathRegex: "(", Action: mw.ActionDeny}},
+		{{Hosts: []string{"[admin"}, Action: mw.ActionDeny}},
+	} {
+		mwCfg.Rules = rules
+		if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+			t.Fatalf("Must fail on invalid rules %v", rules)
+		}
+	}
+}
+
+func TestReportOnly(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-Country", map[string]interface{}{
+		"5.1.0.0/16": map[string]interface{}{"country": map[string]interface{}{"iso_code": "DE"}},
+		"5.3.0.0/16": map[string]interface{}{"country": map[string]interface{}{"iso_code": "RU"}},
+	})
+	mwCfg.DenyCountries = []string{"RU"}
+	mwCfg.Rules = []mw.Rule{
+		{Name: "admin", PathPrefixes: []string{"/admin/"}, Countries: []string{"DE"}, Action: mw.ActionDeny, ReportOnly: true},
+	}
+	mwCfg.MetricsPath = "/geoip2/metrics"
+
+	var wouldBlock string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		wouldBlock = req.Header.Get(mw.WouldBlockHeader)
+	})
+	mw.ResetLookup()
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	serve := func(url, remoteAddr string) *httptest.ResponseRecorder {
+		wouldBlock = ""
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(mw.WouldBlockHeader, "spoofed")
+		instance.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	if rec := serve("http://localhost/admin/users", "5.1.0.1:9999"); rec.Code != http.StatusOK ||
+		wouldBlock != "deny; reason=rule:admin" {
+		t.Fatalf("invalid report-only rule response: %d, %q", rec.Code, wouldBlock)
+	}
+	if rec := serve("http://localhost/", "5.1.0.1:9999"); rec.Code != http.StatusOK || wouldBlock != "" {
+		t.Fatalf("invalid allowed response: %d, %q", rec.Code, wouldBlock)
+	}
+	if rec := serve("http://localhost/", "5.3.0.1:9999"); rec.Code != http.StatusForbidden {
+		t.Fatalf("invalid blocked response: %d", rec.Code)
+	}
+
+	rec := serve("http://localhost/geoip2/metrics", "5.1.0.1:9999")
+	for _, line := range []string{
+		`geoip2_decisions_total{middleware="traefik-geoip2",action="deny",reason="country:RU",report_only="false"} 1`,
+		`geoip2_decisions_total{middleware="traefik-geoip2",action="deny",reason="rule:admin",report_only="true"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Fatalf("missing metric %s in\n%s", line, rec.Body.String())
+		}
+	}
+
+	mwCfg.Rules = nil
+	mwCfg.ReportOnly = true
+	instance, _ = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if rec := serve("http://localhost/", "5.3.0.1:9999"); rec.Code != http.StatusOK ||
+		wouldBlock != "deny; reason=country:RU" {
+		t.Fatalf("invalid global report-only response: %d, %q", rec.Code, wouldBlock)
+	}
+
+	mwCfg.Redirects = &mw.Redirects{Rules: []mw.Redirect{{Country: "DE", Target: "https://example.de"}}}
+	instance, _ = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if rec := serve("http://localhost/", "5.1.0.1:9999"); rec.Code != http.StatusOK ||
+		wouldBlock != "redirect; reason=redirect:country:DE" {
+		t.Fatalf("invalid report-only redirect response: %d, %q", rec.Code, wouldBlock)
+	}
+}
+
+func TestReportOnlySignature(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-Country", map[string]interface{}{
+		"5.3.0.0/16": map[string]interface{}{"country": map[string]interface{}{"iso_code": "RU"}},
+	})
+	mwCfg.DenyCountries = []string{"RU"}
+	mwCfg.ReportOnly = true
+	mwCfg.Signature = &mw.Signature{Header: "X-Geoip-Signature", Secret: "s3cr3t"}
+
+	var backend http.Header
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { backend = req.Header })
+	mw.ResetLookup()
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "5.3.0.1:9999"
+	instance.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK || backend.Get(mw.WouldBlockHeader) != "deny; reason=country:RU" {
+		t.Fatalf("invalid report-only response: %d, %q", recorder.Code, backend.Get(mw.WouldBlockHeader))
+	}
+
+	verifier := mw.SignatureVerifier{Header: "X-Geoip-Signature", Secret: "s3cr3t", MaxAge: time.Minute}
+	if err = verifier.Verify(backend, "5.3.0.1"); err != nil {
+		t.Fatalf("Error verifying %v", err)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-Country", map[string]interface{}{
+		"5.1.0.0/16": map[string]interface{}{"country": map[string]interface{}{"iso_code": "DE"}},
+		"5.3.0.0/16": map[string]interface{}{"country": map[string]interface{}{"iso_code": "RU"}},
+	})
+	mwCfg.RateLimits = []mw.RateLimit{{Key: mw.RateLimitCountry, Rate: 0.5, Burst: 2}}
+	mwCfg.MetricsPath = "/geoip2/metrics"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	mw.ResetLookup()
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+	serve := func(remoteAddr string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = remoteAddr
+		instance.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	for i, tc := range []struct {
+		remoteAddr string
+		code       int
+	}{
+		{"5.3.0.1:9999", http.StatusOK},
+		{"5.3.0.2:9999", http.StatusOK},
+		{"5.3.0.3:9999", http.StatusTooManyRequests},
+		{"5.1.0.1:9999", http.StatusOK},
+	} {
+		rec := serve(tc.remoteAddr)
+		if rec.Code != tc.code {
+			t.Fatalf("invalid return code of request %d from %s: %d", i, tc.remoteAddr, rec.Code)
+		}
+		if tc.code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "2" {
+			t.Fatalf("invalid Retry-After %s", rec.Header().Get("Retry-After"))
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	instance.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://localhost/geoip2/metrics", nil))
+	line := `geoip2_decisions_total{middleware="traefik-geoip2",action="rate_limit",reason="country:RU",report_only="false"} 1`
+	if !strings.Contains(recorder.Body.String(), line+"\n") {
+		t.Fatalf("missing metric %s in\n%s", line, recorder.Body.String())
+	}
+
+	mwCfg.RateLimits = []mw.RateLimit{{Key: mw.RateLimitIP, Rate: 0.001, Burst: 1, MaxKeys: 2}}
+	instance, _ = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	for i, tc := range []struct {
+		remoteAddr string
+		code       int
+	}{
+		{"[2001:db8:1:2::1]:9999", http.StatusOK},
+		{"[2001:db8:1:2::ffff]:9999", http.StatusTooManyRequests},
+		{"[2001:db8:1:3::1]:9999", http.StatusOK},
+		{"5.1.0.1:9999", http.StatusOK},
+		// the bucket of 2001:db8:1:2::/64 was evicted
+		{"[2001:db8:1:2::1]:9999", http.StatusOK},
+		{"5.1.0.1:9999", http.StatusTooManyRequests},
+	} {
+		if rec := serve(tc.remoteAddr); rec.Code != tc.code {
+			t.Fatalf("invalid return code of request %d from %s: %d", i, tc.remoteAddr, rec.Code)
+		}
+	}
+
+	mwCfg.RateLimits = []mw.RateLimit{{Key: mw.RateLimitCountry, Rate: 0.001, Burst: 10}}
+	instance, _ = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	codes := make(chan int, 50)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- serve("5.1.0.1:9999").Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	allowed := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			allowed++
+		}
+	}
+	if allowed != 10 {
+		t.Fatalf("invalid number of allowed concurrent requests %d", allowed)
+	}
+
+	for _, limits := range [][]mw.RateLimit{
+		{{Key: "city", Rate: 1, Burst: 1}},
+		{{Key: mw.RateLimitIP, Rate: 0, Burst: 1}},
+		{{Key: mw.RateLimitIP, Rate: 1}},
+	} {
+		mwCfg.RateLimits = limits
+		if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+			t.Fatalf("Must fail on invalid rate limits %v", limits)
+		}
+	}
+}
+
+func TestBypass(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-Country", map[string]interface{}{
+		"5.3.0.0/16": map[string]interface{}{"country": map[string]interface{}{"iso_code": "RU"}},
+	})
+	mwCfg.DenyCountries = []string{"RU"}
+	mwCfg.Bypass = &mw.Bypass{
+		CIDRs:  []string{"5.3.0.0/16", "!5.3.1.0/24", "5.3.1.128/25", "2001:db8::/32"},
+		Header: "X-Geo-Bypass",
+		Secret: "s3cret",
+	}
+
+	var country, secret string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		country, secret = req.Header.Get(CountryHeader), req.Header.Get("X-Geo-Bypass")
+	})
+	mw.ResetLookup()
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+	serve := func(remoteAddr, bypassSecret string) int {
+		country, secret = "", ""
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = remoteAddr
+		if bypassSecret != "" {
+			req.Header.Set("X-Geo-Bypass", bypassSecret)
+		}
+		instance.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	for _, tc := range []struct {
+		remoteAddr string
+		secret     string
+		code       int
+		country    string
+	}{
+		{"5.3.0.1:9999", "", http.StatusOK, "RU"},
+		{"5.3.1.1:9999", "", http.StatusForbidden, ""},
+		{"5.3.1.200:9999", "", http.StatusOK, "RU"},
+		{"[2001:db8::1]:9999", "", http.StatusOK, mw.Unknown},
+		{"5.3.1.1:9999", "s3cret", http.StatusOK, "RU"},
+		{"5.3.1.1:9999", "wrong", http.StatusForbidden, ""},
+	} {
+		if code := serve(tc.remoteAddr, tc.secret); code != tc.code || country != tc.country || secret != "" {
+			t.Fatalf("invalid response for %s with secret %q: %d, country %q, secret %q",
+				tc.remoteAddr, tc.secret, code, country, secret)
+		}
+	}
+
+	mwCfg.Bypass.SkipLookup = true
+	instance, _ = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if code := serve("5.3.0.1:9999", ""); code != http.StatusOK || country != "" {
+		t.Fatalf("invalid response without lookup: %d, country %q", code, country)
+	}
+
+	for _, bypass := range []*mw.Bypass{
+		{CIDRs: []string{"5.3.0.0"}},
+		{Header: "X-Geo-Bypass"},
+	} {
+		mwCfg.Bypass = bypass
+		if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+			t.Fatalf("Must fail on invalid bypass %v", bypass)
+		}
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-City", map[string]interface{}{
+		"5.1.0.0/16": map[string]interface{}{
+			"country":  map[string]interface{}{"iso_code": "US"},
+			"location": map[string]interface{}{"latitude": 37.77, "longitude": -122.42, "accuracy_radius": uint16(5)},
+		},
+		"5.2.0.0/16": map[string]interface{}{"country": map[string]interface{}{"iso_code": "CA"}},
+		"5.3.0.0/16": map[string]interface{}{"country": map[string]interface{}{"iso_code": "DE"}},
+		"5.4.0.0/16": map[string]interface{}{
+			"country":      map[string]interface{}{"iso_code": "UA"},
+			"subdivisions": []interface{}{map[string]interface{}{"iso_code": "43"}},
+		},
+	})
+	mwCfg.ASNDBPath = writeTestDB(t, "GeoLite2-ASN", map[string]interface{}{
+		"5.3.0.0/16": map[string]interface{}{"autonomous_system_number": uint32(13335)},
+	})
+	mwCfg.AnonymousIPDBPath = writeTestDB(t, "GeoIP2-Anonymous-IP", map[string]interface{}{
+		"5.2.0.0/16": map[string]interface{}{"is_anonymous": true, "is_anonymous_vpn": true},
+	})
+	mwCfg.Expressions = []mw.Expression{
+		{Name: "trusted", When: `country in ["US","CA"] && !anonymous.vpn || asn == 13335`, Action: mw.ActionTag},
+		{Name: "west", When: `longitude < -100 && accuracy_radius <= 10`, Action: mw.ActionTag},
+		{Name: "crimea", When: `"UA-43" in subdivisions`, Action: mw.ActionDeny},
+		{Name: "admin", When: `path matches "^/admin(/|$)" && !(country == "US")`, Action: mw.ActionRedirect, Target: "/"},
+		{Name: "vpn", When: `anonymous.vpn`, Action: mw.ActionRedirect, Target: "/vpn"},
+		{Name: "api", When: `header["X-Api-Key"] != null && method != 'GET' && query.debug == "1"`,
+			Action: mw.ActionHeader, Header: "X-Debug", Value: "on"},
+	}
+	mwCfg.Headers = mw.Headers{mw.FieldTags: "X-Geo-Tags"}
+
+	var tags, debug string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		tags, debug = req.Header.Get("X-Geo-Tags"), req.Header.Get("X-Debug")
+	})
+	mw.ResetLookup()
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+
+	for _, tc := range []struct {
+		method     string
+		url        string
+		remoteAddr string
+		code       int
+		tags       string
+		debug      string
+	}{
+		{http.MethodGet, "http://localhost/", "5.1.0.1:9999", http.StatusOK, "trusted,west", ""},
+		{http.MethodGet, "http://localhost/", "5.2.0.1:9999", http.StatusFound, "", ""},
+		{http.MethodGet, "http://localhost/vpn", "5.2.0.1:9999", http.StatusOK, mw.Unknown, ""},
+		{http.MethodGet, "http://localhost/", "5.3.0.1:9999", http.StatusOK, "trusted", ""},
+		{http.MethodGet, "http://localhost/", "5.4.0.1:9999", http.StatusForbidden, "", ""},
+		{http.MethodGet, "http://localhost/admin/users", "5.3.0.1:9999", http.StatusFound, "", ""},
+		{http.MethodGet, "http://localhost/admin/users", "5.1.0.1:9999", http.StatusOK, "trusted,west", ""},
+		{http.MethodPost, "http://localhost/api?debug=1", "5.3.0.1:9999", http.StatusOK, "trusted", "on"},
+		{http.MethodGet, "http://localhost/api?debug=1", "5.3.0.1:9999", http.StatusOK, "trusted", ""},
+	} {
+		tags, debug = "", ""
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(tc.method, tc.url, nil)
+		req.RemoteAddr = tc.remoteAddr
+		req.Header.Set("X-Api-Key", "key")
+		req.Header.Set("X-Debug", "spoofed")
+		instance.ServeHTTP(recorder, req)
+		if recorder.Code != tc.code || tags != tc.tags || debug != tc.debug {
+			t.Fatalf("invalid response for %s %s from %s: %d, tags %q, debug %q",
+				tc.method, tc.url, tc.remoteAddr, recorder.Code, tags, debug)
+		}
+	}
+
+	for _, when := range []string{
+		`country ==`,
+		`city == "Berlin`,
+		`unknown_field == 1`,
+		`anonymous.bogus`,
+		`path matches "("`,
+		`country in ["US" "CA"]`,
+		`(country == "US"`,
+		`country $ "US"`,
+		strings.Repeat("(", 100) + "true" + strings.Repeat(")", 100),
+	} {
+		mwCfg.Expressions = []mw.Expression{{When: when, Action: mw.ActionDeny}}
+		if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+			t.Fatalf("Must fail on invalid expression %s", when)
+		}
+	}
+	mwCfg.Expressions = []mw.Expression{{When: "true", Action: mw.ActionRedirect}}
+	if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+		t.Fatalf("Must fail on redirect without target")
+	}
+}
+
+func TestFeatureFlags(t *testing.T) {
+	mwCfg := mw.CreateConfig()
+	mwCfg.DBPath = writeTestDB(t, "GeoLite2-City", map[string]interface{}{
+		"5.0.0.0/8": map[string]interface{}{
+			"continent": map[string]interface{}{"code": "EU"},
+			"country":   map[string]interface{}{"iso_code": "DE"},
+		},
+		"6.0.0.0/8": map[string]interface{}{
+			"continent":    map[string]interface{}{"code": "NA"},
+			"country":      map[string]interface{}{"iso_code": "US"},
+			"subdivisions": []interface{}{map[string]interface{}{"iso_code": "CA"}},
+		},
+	})
+	half := 50.0
+	none := 0.0
+	mwCfg.FeatureFlags = []mw.FeatureFlag{
+		{Name: "new-checkout", Countries: []string{"de", "AT"}},
+		{Name: "beta-search", Continents: []string{"NA"}},
+		{Name: "west-coast", Subdivisions: []string{"US-CA"}},
+		{Name: "everywhere"},
+		{Name: "half", Percentage: &half},
+		{Name: "off", Percentage: &none},
+	}
+
+	var flags string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		flags = req.Header.Get(mw.DefaultFeatureFlagsHeader)
+	})
+	mw.ResetLookup()
+	instance, err := mw.New(context.TODO(), next, mwCfg, "traefik-geoip2")
+	if err != nil {
+		t.Fatalf("Error creating %v", err)
+	}
+	serve := func(remoteAddr string) string {
+		flags = ""
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(mw.DefaultFeatureFlagsHeader, "spoofed")
+		instance.ServeHTTP(httptest.NewRecorder(), req)
+		return strings.TrimSuffix(flags, ",half")
+	}
+
+	if flags := serve("5.1.0.1:9999"); flags != "new-checkout,everywhere" {
+		t.Fatalf("invalid flags for DE: %q", flags)
+	}
+	if flags := serve("6.1.0.1:9999"); flags != "beta-search,west-coast,everywhere" {
+		t.Fatalf("invalid flags for US-CA: %q", flags)
+	}
+
+	rolledOut := 0
+	for i := 0; i < 1000; i++ {
+		remoteAddr := fmt.Sprintf("5.1.%d.%d:9999", i/250, i%250)
+		serve(remoteAddr)
+		first := flags
+		if serve(remoteAddr); flags != first {
+			t.Fatalf("rollout for %s is not deterministic: %q != %q", remoteAddr, flags, first)
+		}
+		if strings.HasSuffix(flags, ",half") {
+			rolledOut++
+		}
+	}
+	if rolledOut < 400 || rolledOut > 600 {
+		t.Fatalf("invalid share of clients in the 50%% rollout: %d of 1000", rolledOut)
+	}
+
+	for _, features := range [][]mw.FeatureFlag{
+		{{Name: ""}},
+		{{Name: "a,b"}},
+		{{Name: "a"}, {Name: "a"}},
+		{{Name: "a", ASNs: []string{"ASX"}}},
+		{{Name: "a", Percentage: func() *float64 { p := 101.0; return &p }()}},
+	} {
+		mwCfg.FeatureFlags = features
+		if _, err = mw.New(context.TODO(), next, mwCfg, "traefik-geoip2"); err == nil {
+			t.Fatalf("Must fail on invalid feature flags %v", features)
+		}
+	}
 }
 
 func assertHeader(t *testing.T, req *http.Request, key, expected string) {
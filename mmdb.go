@@ -0,0 +1,385 @@
+package traefikgeoip2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/IncSW/geoip2"
+)
+
+// MMDB data section types, see https://maxmind.github.io/MaxMind-DB/.
+const (
+	mmdbExtended  = 0
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbFloat64   = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbSlice     = 11
+	mmdbContainer = 12
+	mmdbEndMarker = 13
+	mmdbBool      = 14
+	mmdbFloat32   = 15
+
+	mmdbSeparatorSize = 16
+	mmdbMaxDepth      = 64
+)
+
+// MMDBReader reads any MMDB-format file and decodes records without a fixed schema.
+type MMDBReader struct {
+	metadata   map[string]interface{}
+	nodes      []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipV4Start  uint
+}
+
+// NewMMDBReader creates a generic reader from the database contents.
+func NewMMDBReader(buffer []byte) (*MMDBReader, error) {
+	metadataStart := bytes.LastIndex(buffer, mmdbMetadataMarker)
+	if metadataStart == -1 {
+		return nil, errors.New("invalid MaxMind DB: metadata section not found")
+	}
+	metadataBuffer := buffer[metadataStart+len(mmdbMetadataMarker):]
+	value, _, err := decodeMMDB(metadataBuffer, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MaxMind DB metadata: %w", err)
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid MaxMind DB metadata: not a map")
+	}
+
+	rdr := &MMDBReader{metadata: metadata}
+	rdr.nodeCount, _ = mmdbUint(metadata["node_count"])
+	rdr.recordSize, _ = mmdbUint(metadata["record_size"])
+	rdr.ipVersion, _ = mmdbUint(metadata["ip_version"])
+	if rdr.recordSize != 24 && rdr.recordSize != 28 && rdr.recordSize != 32 {
+		return nil, fmt.Errorf("invalid MaxMind DB record size: %d", rdr.recordSize)
+	}
+
+	treeSize := rdr.nodeCount * rdr.recordSize / 4
+	if treeSize+mmdbSeparatorSize > uint(metadataStart) {
+		return nil, errors.New("invalid MaxMind DB: search tree exceeds file size")
+	}
+	rdr.nodes = buffer[:treeSize]
+	rdr.data = buffer[treeSize+mmdbSeparatorSize : metadataStart]
+
+	if rdr.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < rdr.nodeCount; i++ {
+			node = rdr.readNode(node, 0)
+		}
+		rdr.ipV4Start = node
+	}
+	return rdr, nil
+}
+
+// NewMMDBReaderFromFile creates a generic reader from the database file.
+func NewMMDBReaderFromFile(filename string) (*MMDBReader, error) {
+	buffer, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return NewMMDBReader(buffer)
+}
+
+// DatabaseType returns the database_type declared in the metadata.
+func (r *MMDBReader) DatabaseType() string {
+	s, _ := r.metadata["database_type"].(string)
+	return s
+}
+
+// Metadata returns the decoded metadata map.
+func (r *MMDBReader) Metadata() map[string]interface{} {
+	return r.metadata
+}
+
+// Lookup returns the decoded record for the ip: maps, slices and scalars.
+func (r *MMDBReader) Lookup(ip net.IP) (interface{}, error) {
+	if ip == nil {
+		return nil, errors.New("IP cannot be nil")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else if r.ipVersion == 4 {
+		return nil, errors.New("cannot look up an IPv6 address in an IPv4-only database")
+	}
+
+	node := uint(0)
+	if len(ip) == net.IPv4len {
+		node = r.ipV4Start
+	}
+	bitCount := uint(len(ip)) * 8
+	for i := uint(0); i < bitCount && node < r.nodeCount; i++ {
+		bit := 1 & (ip[i>>3] >> (7 - (i % 8)))
+		node = r.readNode(node, uint(bit))
+	}
+	if node == r.nodeCount {
+		return nil, geoip2.ErrNotFound
+	}
+	if node < r.nodeCount {
+		return nil, errors.New("invalid node in search tree")
+	}
+
+	offset := node - r.nodeCount - mmdbSeparatorSize
+	if offset >= uint(len(r.data)) {
+		return nil, errors.New("the MaxMind DB search tree is corrupt: " + strconv.Itoa(int(node)))
+	}
+	value, _, err := decodeMMDB(r.data, offset, 0)
+	return value, err
+}
+
+func (r *MMDBReader) readNode(node, bit uint) uint {
+	b := r.nodes[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		if bit == 0 {
+			return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5])
+	case 28:
+		if bit == 0 {
+			return (uint(b[3])&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return (uint(b[3])&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		if bit == 0 {
+			return uint(binary.BigEndian.Uint32(b[0:4]))
+		}
+		return uint(binary.BigEndian.Uint32(b[4:8]))
+	}
+}
+
+// mmdbReadControl mirrors the vendored geoip2 readControl, which is not exported.
+func mmdbReadControl(buffer []byte, offset uint) (byte, uint, uint, error) {
+	if offset >= uint(len(buffer)) {
+		return 0, 0, 0, errors.New("invalid offset")
+	}
+	controlByte := buffer[offset]
+	offset++
+	dataType := controlByte >> 5
+	if dataType == mmdbExtended {
+		if offset >= uint(len(buffer)) {
+			return 0, 0, 0, errors.New("invalid offset")
+		}
+		dataType = buffer[offset] + 7
+		offset++
+	}
+	size := uint(controlByte & 0x1f)
+	if dataType == mmdbPointer || size < 29 {
+		return dataType, size, offset, nil
+	}
+	bytesToRead := size - 28
+	newOffset := offset + bytesToRead
+	if newOffset > uint(len(buffer)) {
+		return 0, 0, 0, errors.New("invalid offset")
+	}
+	size = uint(mmdbUintBytes(0, buffer[offset:newOffset]))
+	switch bytesToRead {
+	case 1:
+		size += 29
+	case 2:
+		size += 285
+	default:
+		size += 65821
+	}
+	return dataType, size, newOffset, nil
+}
+
+// mmdbReadPointer mirrors the vendored geoip2 readPointer, which is not exported.
+func mmdbReadPointer(buffer []byte, size uint, offset uint) (uint, uint, error) {
+	pointerSize := ((size >> 3) & 0x3) + 1
+	newOffset := offset + pointerSize
+	if newOffset > uint(len(buffer)) {
+		return 0, 0, errors.New("invalid offset")
+	}
+	prefix := uint64(0)
+	if pointerSize != 4 {
+		prefix = uint64(size) & 0x7
+	}
+	unpacked := uint(mmdbUintBytes(prefix, buffer[offset:newOffset]))
+	switch pointerSize {
+	case 2:
+		unpacked += 2048
+	case 3:
+		unpacked += 526336
+	}
+	return unpacked, newOffset, nil
+}
+
+// decodeMMDB decodes the value at offset and returns it along with the offset following it.
+func decodeMMDB(buffer []byte, offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("maximum data structure depth exceeded")
+	}
+	dataType, size, offset, err := mmdbReadControl(buffer, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if dataType == mmdbPointer {
+		pointer, newOffset, err := mmdbReadPointer(buffer, size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := decodeMMDB(buffer, pointer, depth+1)
+		return value, newOffset, err
+	}
+
+	switch dataType {
+	case mmdbMap:
+		result := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			key, offset, err = decodeMMDB(buffer, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			s, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key must be a string, got: %T", key)
+			}
+			value, offset, err = decodeMMDB(buffer, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			result[s] = value
+		}
+		return result, offset, nil
+	case mmdbSlice:
+		result := make([]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			result[i], offset, err = decodeMMDB(buffer, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return result, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+
+	newOffset := offset + size
+	if newOffset > uint(len(buffer)) {
+		return nil, 0, errors.New("invalid offset")
+	}
+	raw := buffer[offset:newOffset]
+	switch dataType {
+	case mmdbString:
+		return string(raw), newOffset, nil
+	case mmdbBytes:
+		return append([]byte(nil), raw...), newOffset, nil
+	case mmdbFloat64:
+		if size != 8 {
+			return nil, 0, errors.New("invalid float64 size: " + strconv.Itoa(int(size)))
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), newOffset, nil
+	case mmdbFloat32:
+		if size != 4 {
+			return nil, 0, errors.New("invalid float32 size: " + strconv.Itoa(int(size)))
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(raw)), newOffset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, errors.New("invalid unsigned integer size: " + strconv.Itoa(int(size)))
+		}
+		return mmdbUintBytes(0, raw), newOffset, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, errors.New("invalid int32 size: " + strconv.Itoa(int(size)))
+		}
+		shift := 32 - 8*size
+		return int64(int32(uint32(mmdbUintBytes(0, raw))<<shift) >> shift), newOffset, nil
+	case mmdbUint128:
+		return new(big.Int).SetBytes(raw), newOffset, nil
+	default:
+		return nil, 0, errors.New("invalid data type: " + strconv.Itoa(int(dataType)))
+	}
+}
+
+func mmdbUintBytes(prefix uint64, buffer []byte) uint64 {
+	value := prefix
+	for _, b := range buffer {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+func mmdbUint(value interface{}) (uint, bool) {
+	v, ok := value.(uint64)
+	return uint(v), ok
+}
+
+// LookupPath resolves a dotted field path such as `traits.autonomous_system_number`
+// or `subdivisions.0.iso_code` in a decoded record.
+func LookupPath(value interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return value, value != nil
+	}
+	for _, part := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = v[part]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			idx, err := strconv.Atoi(part)
+			if err != nil || idx < 0 || idx >= len(v) {
+				return nil, false
+			}
+			value = v[idx]
+		default:
+			return nil, false
+		}
+	}
+	return value, value != nil
+}
+
+// FormatValue renders a decoded scalar as a header value.
+func FormatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case *big.Int:
+		return v.String()
+	case []byte:
+		return fmt.Sprintf("%x", v)
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			parts = append(parts, FormatValue(item))
+		}
+		return strings.Join(parts, ",")
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,217 @@
+package traefikgeoip2_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	mw "github.com/prochri/traefikgeoip2"
+)
+
+// writeTestDB builds a minimal IPv4 MMDB file with one record per CIDR.
+// Values are encoded by Go type: uint16, uint32, uint64, int32, float64,
+// bool, string, []interface{} and map[string]interface{}.
+func writeTestDB(t *testing.T, dbType string, records map[string]interface{}) string {
+	t.Helper()
+
+	const empty = -1
+	type node [2]int // >= 0 child node, <= -2 data record -(index+2), -1 empty
+	nodes := []node{{empty, empty}}
+
+	cidrs := make([]string, 0, len(records))
+	for cidr := range records {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+
+	var data bytes.Buffer
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("invalid CIDR %s: %v", cidr, err)
+		}
+		ones, _ := ipNet.Mask.Size()
+		ip := ipNet.IP.To4()
+
+		offsets := data.Len()
+		encodeTestValue(&data, records[cidr])
+
+		cur := 0
+		for bitIdx := 0; bitIdx < ones; bitIdx++ {
+			bit := int(ip[bitIdx/8]>>(7-uint(bitIdx%8))) & 1
+			if bitIdx == ones-1 {
+				nodes[cur][bit] = -(offsets + 2)
+				break
+			}
+			if nodes[cur][bit] < 0 {
+				nodes = append(nodes, node{empty, empty})
+				nodes[cur][bit] = len(nodes) - 1
+			}
+			cur = nodes[cur][bit]
+		}
+	}
+
+	var out bytes.Buffer
+	nodeCount := uint32(len(nodes))
+	for _, n := range nodes {
+		for _, rec := range n {
+			var value uint32
+			switch {
+			case rec == empty:
+				value = nodeCount
+			case rec < empty:
+				value = nodeCount + 16 + uint32(-rec-2)
+			default:
+				value = uint32(rec)
+			}
+			_ = binary.Write(&out, binary.BigEndian, value)
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+	out.WriteString("\xAB\xCD\xEFMaxMind.com")
+	encodeTestValue(&out, map[string]interface{}{
+		"node_count":                  nodeCount,
+		"record_size":                 uint16(32),
+		"ip_version":                  uint16(4),
+		"database_type":               dbType,
+		"languages":                   []interface{}{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1600000000),
+		"description":                 map[string]interface{}{"en": "test database"},
+	})
+
+	path := filepath.Join(t.TempDir(), dbType+".mmdb")
+	if err := os.WriteFile(path, out.Bytes(), 0o600); err != nil {
+		t.Fatalf("unable to write test DB: %v", err)
+	}
+	return path
+}
+
+func encodeTestControl(buf *bytes.Buffer, dataType int, size int) {
+	var sizeBits byte
+	var extra []byte
+	switch {
+	case size < 29:
+		sizeBits = byte(size)
+	case size < 285:
+		sizeBits, extra = 29, []byte{byte(size - 29)}
+	case size < 65821:
+		sizeBits, extra = 30, []byte{byte((size - 285) >> 8), byte(size - 285)}
+	default:
+		s := size - 65821
+		sizeBits, extra = 31, []byte{byte(s >> 16), byte(s >> 8), byte(s)}
+	}
+	if dataType < 8 {
+		buf.WriteByte(byte(dataType<<5) | sizeBits)
+	} else {
+		buf.WriteByte(sizeBits)
+		buf.WriteByte(byte(dataType - 7))
+	}
+	buf.Write(extra)
+}
+
+func encodeTestUint(buf *bytes.Buffer, dataType int, value uint64) {
+	var raw []byte
+	for value > 0 {
+		raw = append([]byte{byte(value)}, raw...)
+		value >>= 8
+	}
+	encodeTestControl(buf, dataType, len(raw))
+	buf.Write(raw)
+}
+
+func encodeTestValue(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		encodeTestControl(buf, 2, len(v))
+		buf.WriteString(v)
+	case float64:
+		encodeTestControl(buf, 3, 8)
+		_ = binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case uint16:
+		encodeTestUint(buf, 5, uint64(v))
+	case uint32:
+		encodeTestUint(buf, 6, uint64(v))
+	case int32:
+		encodeTestControl(buf, 8, 4)
+		_ = binary.Write(buf, binary.BigEndian, v)
+	case uint64:
+		encodeTestUint(buf, 9, v)
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		encodeTestControl(buf, 14, size)
+	case []interface{}:
+		encodeTestControl(buf, 11, len(v))
+		for _, item := range v {
+			encodeTestValue(buf, item)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		encodeTestControl(buf, 7, len(v))
+		for _, k := range keys {
+			encodeTestValue(buf, k)
+			encodeTestValue(buf, v[k])
+		}
+	default:
+		panic(fmt.Sprintf("unsupported test value %T", value))
+	}
+}
+
+func TestMMDBReaderLookup(t *testing.T) {
+	path := writeTestDB(t, "Internal-Zones", map[string]interface{}{
+		"10.0.0.0/8": map[string]interface{}{
+			"zone":   map[string]interface{}{"owner": "netops", "tags": []interface{}{"dc1", "rack7"}},
+			"traits": map[string]interface{}{"autonomous_system_number": uint32(64512)},
+			"offset": int32(-7),
+			"weight": 0.5,
+		},
+	})
+
+	rdr, err := mw.NewMMDBReaderFromFile(path)
+	if err != nil {
+		t.Fatalf("Error creating reader %v", err)
+	}
+	if rdr.DatabaseType() != "Internal-Zones" {
+		t.Fatalf("invalid database type %s", rdr.DatabaseType())
+	}
+
+	record, err := rdr.Lookup(net.ParseIP(LocalIP))
+	if err != nil {
+		t.Fatalf("Error looking up %v", err)
+	}
+	for path, expected := range map[string]string{
+		"zone.owner":                      "netops",
+		"zone.tags":                       "dc1,rack7",
+		"zone.tags.1":                     "rack7",
+		"traits.autonomous_system_number": "64512",
+		"offset":                          "-7",
+		"weight":                          "0.5",
+	} {
+		value, ok := mw.LookupPath(record, path)
+		if !ok || mw.FormatValue(value) != expected {
+			t.Fatalf("invalid value of [%s] %v != %s", path, value, expected)
+		}
+	}
+	if _, ok := mw.LookupPath(record, "zone.tags.2"); ok {
+		t.Fatalf("out of range index must not resolve")
+	}
+
+	if _, err = rdr.Lookup(net.ParseIP(ValidIP)); err == nil {
+		t.Fatalf("Lookup outside of any network must fail")
+	}
+}
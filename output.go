@@ -0,0 +1,223 @@
+package traefikgeoip2
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Encodings of the JSON header.
+const (
+	EncodingJSON      = "json"
+	EncodingBase64URL = "base64url"
+)
+
+// JSONHeader part of the configuration, the whole lookup result serialized into one header.
+type JSONHeader struct {
+	Name     string   `json:"name"`
+	Encoding string   `json:"encoding,omitempty"`
+	Fields   []string `json:"fields,omitempty"`
+	Replace  bool     `json:"replace,omitempty"`
+}
+
+// values returns the present fields along with the lookup status and source.
+func (r *GeoIPResult) values() map[string]string {
+	values := make(map[string]string, len(r.fields)+2)
+	for field, value := range r.fields {
+		values[field] = value
+	}
+	if r.status != "" {
+		values["status"] = r.status
+	}
+	if r.source != "" {
+		values["source"] = r.source
+	}
+	return values
+}
+
+func (a *TraefikGeoIP2) addJSONHeader(req *http.Request, record *GeoIPResult) {
+	if a.jsonHeader == nil || a.jsonHeader.Name == "" {
+		return
+	}
+
+	values := record.values()
+	if len(a.jsonHeader.Fields) > 0 {
+		selected := make(map[string]string, len(a.jsonHeader.Fields))
+		for _, field := range a.jsonHeader.Fields {
+			if value, ok := values[field]; ok {
+				selected[field] = value
+			}
+		}
+		values = selected
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		logErr.Printf("Unable to serialize GeoIP data: %v", err)
+		return
+	}
+	value := string(data)
+	if a.jsonHeader.Encoding == EncodingBase64URL {
+		value = base64.RawURLEncoding.EncodeToString(data)
+	}
+	req.Header.Set(a.jsonHeader.Name, value)
+}
+
+type headerTemplate struct {
+	name string
+	tmpl *template.Template
+}
+
+func parseHeaderTemplates(cfg map[string]string) ([]headerTemplate, error) {
+	templates := make([]headerTemplate, 0, len(cfg))
+	for name, text := range cfg {
+		tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for header %s: %w", name, err)
+		}
+		if err = tmpl.Execute(ioutil.Discard, map[string]string{}); err != nil {
+			return nil, fmt.Errorf("invalid template for header %s: %w", name, err)
+		}
+		templates = append(templates, headerTemplate{name: name, tmpl: tmpl})
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].name < templates[j].name })
+	return templates, nil
+}
+
+// templateData exposes the result fields in CamelCase, e.g. `country_name` as `.CountryName`.
+func (r *GeoIPResult) templateData() map[string]string {
+	data := make(map[string]string, len(r.fields)+2)
+	for field, value := range r.values() {
+		data[camelCase(field)] = value
+	}
+	return data
+}
+
+func camelCase(field string) string {
+	parts := strings.Split(field, "_")
+	for i, part := range parts {
+		if part != "" {
+			parts[i] = strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+func (a *TraefikGeoIP2) addTemplateHeaders(req *http.Request, record *GeoIPResult) {
+	if len(a.templates) == 0 {
+		return
+	}
+	data := record.templateData()
+	for _, ht := range a.templates {
+		var buf strings.Builder
+		if err := ht.tmpl.Execute(&buf, data); err != nil {
+			logWarn.Printf("Unable to render header %s: %v", ht.name, err)
+			continue
+		}
+		req.Header.Set(ht.name, buf.String())
+	}
+}
+
+// addStructuredHeader writes the fields selected in Headers as one RFC 8941 Dictionary,
+// e.g. `country="DE", latitude=48.137, eu`.
+func (a *TraefikGeoIP2) addStructuredHeader(req *http.Request, record *GeoIPResult) {
+	if a.structuredHeader == "" {
+		return
+	}
+	var members []string
+	seen := map[string]bool{}
+	for _, h := range a.headers {
+		if seen[h.field] {
+			continue
+		}
+		seen[h.field] = true
+		value, ok := record.get(h.field)
+		if !ok {
+			continue
+		}
+		if member, ok := sfMember(sfKey(h.field), h.field, value); ok {
+			members = append(members, member)
+		}
+	}
+	if len(members) > 0 {
+		req.Header.Set(a.structuredHeader, strings.Join(members, ", "))
+	}
+}
+
+// sfKey lowercases the field and replaces characters not allowed in a Dictionary key.
+func sfKey(field string) string {
+	key := []byte(strings.ToLower(field))
+	for i, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.' || c == '*') {
+			key[i] = '_'
+		}
+	}
+	if len(key) == 0 || !(key[0] >= 'a' && key[0] <= 'z' || key[0] == '*') {
+		key = append([]byte("f"), key...)
+	}
+	return string(key)
+}
+
+func sfMember(key, field, value string) (string, bool) {
+	switch field {
+	case FieldLatitude, FieldLongitude:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.Abs(f) >= 1e12 {
+			return "", false
+		}
+		return key + "=" + sfDecimal(f), true
+	case FieldAccuracy, FieldASN:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || i > 999999999999999 || i < -999999999999999 {
+			return "", false
+		}
+		return key + "=" + strconv.FormatInt(i, 10), true
+	case FieldEU:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", false
+		}
+		if b {
+			return key, true
+		}
+		return key + "=?0", true
+	default:
+		return key + "=" + sfString(value), true
+	}
+}
+
+// sfDecimal rounds to the three fractional digits allowed for a Decimal.
+func sfDecimal(f float64) string {
+	s := strconv.FormatFloat(math.RoundToEven(f*1000)/1000, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+// sfString quotes a String, RFC 8941 only allows printable ASCII, so other values are transliterated.
+func sfString(value string) string {
+	value = transliterate(value)
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c < 0x20 || c > 0x7e:
+			b.WriteByte('?')
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,221 @@
+package traefikgeoip2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Policy actions.
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+	ActionPass  = "pass"
+)
+
+// decision of the policy, an empty action leaves the request to the next check.
+type decision struct {
+	action string
+	reason string
+	// the decision is only reported, the request goes on
+	reportOnly bool
+	// until a rate limited client may retry
+	retryAfter time.Duration
+	// the target of redirects
+	location string
+	// the status of geo redirects, the others use 302
+	statusCode int
+}
+
+type policy struct {
+	allowCountries map[string]bool
+	// denied codes, mapped to the rule they come from
+	denyCountries    map[string]string
+	denySubdivisions map[string]string
+	// allowed ASNs are exempt from every other rule
+	allowASNs     *asnRules
+	denyASNs      *asnRules
+	unknownAction string
+	privateAction string
+}
+
+func parsePolicy(cfg *Config) (*policy, error) {
+	p := &policy{
+		allowCountries:   countrySet(cfg.AllowCountries),
+		denyCountries:    map[string]string{},
+		denySubdivisions: map[string]string{},
+		unknownAction:    cfg.UnknownCountry,
+		privateAction:    cfg.PrivateIP,
+	}
+	for _, action := range []string{p.unknownAction, p.privateAction} {
+		if err := checkAction(action); err != nil {
+			return nil, err
+		}
+	}
+
+	presets, err := resolvePresets(cfg.Presets, cfg.PresetOverrides)
+	if err != nil {
+		return nil, err
+	}
+	for name, preset := range presets {
+		origin := "preset:" + name
+		if preset.Version != "" {
+			origin += "@" + preset.Version
+		}
+		addCodes(p.denyCountries, preset.Countries, origin+":country")
+		addCodes(p.denySubdivisions, preset.Subdivisions, origin+":subdivision")
+	}
+	addCodes(p.denyCountries, cfg.DenyCountries, "country")
+	addCodes(p.denySubdivisions, cfg.DenySubdivisions, "subdivision")
+
+	if p.allowASNs, err = parseASNRules(cfg.AllowASNs, cfg.AllowASOrgs); err != nil {
+		return nil, err
+	}
+	if p.denyASNs, err = parseASNRules(cfg.DenyASNs, cfg.DenyASOrgs); err != nil {
+		return nil, err
+	}
+
+	if len(p.allowCountries) == 0 && len(p.denyCountries) == 0 && len(p.denySubdivisions) == 0 &&
+		p.allowASNs == nil && p.denyASNs == nil && p.unknownAction == "" && p.privateAction == "" {
+		return nil, nil
+	}
+	return p, nil
+}
+
+func addCodes(set map[string]string, codes []string, origin string) {
+	for _, code := range codes {
+		set[strings.ToUpper(strings.TrimSpace(code))] = origin
+	}
+}
+
+func checkAction(action string) error {
+	switch action {
+	case "", ActionAllow, ActionDeny, ActionPass:
+		return nil
+	default:
+		return fmt.Errorf("invalid policy action %s", action)
+	}
+}
+
+func countrySet(codes []string) map[string]bool {
+	if len(codes) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		set[strings.ToUpper(strings.TrimSpace(code))] = true
+	}
+	return set
+}
+
+// evaluate decides the request, the matching rule comes first and
+// allowed ASNs are exempt from the anonymizer and geofence rules.
+func (mw *TraefikGeoIP2) evaluate(req *http.Request, record *GeoIPResult, r *rule) decision {
+	if r != nil && r.action != ActionTag {
+		return decision{action: r.action, reason: "rule:" + r.name}
+	}
+	if mw.policy == nil || mw.policy.allowASNs.match(record) == "" {
+		if d := mw.anonymizers.evaluate(req, record); d.action != "" {
+			return d
+		}
+		if d := mw.geofences.evaluate(record); d.action != "" {
+			return d
+		}
+	}
+	return mw.policy.evaluate(record)
+}
+
+// report audits a decision in report-only mode and passes it on to the backend.
+func (mw *TraefikGeoIP2) report(req *http.Request, record *GeoIPResult, d decision) {
+	d.reportOnly = true
+	if d.action == ActionRateLimit {
+		// counted only, as enforced rate limits
+		mw.metrics.count(d)
+	} else {
+		mw.audit(req, record, d)
+	}
+	req.Header.Set(WouldBlockHeader, d.action+"; reason="+d.reason)
+}
+
+func (p *policy) evaluate(record *GeoIPResult) decision {
+	if p == nil {
+		return decision{}
+	}
+
+	if rule := p.allowASNs.match(record); rule != "" {
+		return decision{action: ActionAllow, reason: rule}
+	}
+	if rule := p.denyASNs.match(record); rule != "" {
+		return decision{action: ActionDeny, reason: rule}
+	}
+
+	country, ok := record.get(FieldCountry)
+	if !ok {
+		action := p.unknownAction
+		reason := "country:unknown"
+		if record.status == StatusPrivate && p.privateAction != "" {
+			action = p.privateAction
+			reason = "ip:private"
+		}
+		switch action {
+		case ActionAllow, ActionDeny:
+			return decision{action: action, reason: reason}
+		case ActionPass:
+			return decision{}
+		}
+		// unset leaves the decision to the lists below
+	}
+
+	subdivisions, _ := record.get(FieldSubdivision)
+	for _, code := range strings.Split(subdivisions, ",") {
+		if origin, ok := p.denySubdivisions[strings.ToUpper(code)]; ok {
+			return decision{action: ActionDeny, reason: origin + ":" + code}
+		}
+	}
+
+	country = strings.ToUpper(country)
+	if origin, ok := p.denyCountries[country]; ok {
+		return decision{action: ActionDeny, reason: origin + ":" + country}
+	}
+	if p.allowCountries != nil && !p.allowCountries[country] {
+		if country == "" {
+			return decision{action: ActionDeny, reason: "country:unknown"}
+		}
+		return decision{action: ActionDeny, reason: "country:" + country}
+	}
+	return decision{}
+}
+
+// audit logs and counts one JSON record per denied or redirected request.
+func (mw *TraefikGeoIP2) audit(req *http.Request, record *GeoIPResult, d decision) {
+	mw.metrics.count(d)
+	entry := map[string]string{
+		"middleware": mw.name,
+		"action":     d.action,
+		"reason":     d.reason,
+		"ip":         clientIP(req),
+		"method":     req.Method,
+		"host":       req.Host,
+		"path":       req.URL.Path,
+		"status":     record.status,
+	}
+	for _, field := range []string{FieldCountry, FieldSubdivision, FieldASN} {
+		if value, ok := record.get(field); ok {
+			entry[field] = value
+		}
+	}
+	if d.reportOnly {
+		entry["report_only"] = "true"
+	}
+	if len(record.anonymizers) > 0 {
+		entry[FieldAnonymizer] = strings.Join(record.anonymizers, ",")
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logErr.Printf("Unable to serialize audit record: %v", err)
+		return
+	}
+	logAudit.Println(string(data))
+}
@@ -0,0 +1,46 @@
+package traefikgeoip2
+
+import "fmt"
+
+// PresetEmbargo names the built-in embargo preset.
+const PresetEmbargo = "embargo"
+
+// EmbargoPresetVersion identifies the revision of the built-in embargo preset,
+// bump it whenever its countries or subdivisions change.
+const EmbargoPresetVersion = "2025-07"
+
+// Preset part of the configuration, a named set of denied countries and subdivisions.
+type Preset struct {
+	Version      string   `json:"version,omitempty"`
+	Countries    []string `json:"countries,omitempty"`
+	Subdivisions []string `json:"subdivisions,omitempty"`
+}
+
+// builtinPresets returns the presets shipped with the plugin.
+func builtinPresets() map[string]Preset {
+	return map[string]Preset{
+		PresetEmbargo: {
+			Version:   EmbargoPresetVersion,
+			Countries: []string{"CU", "IR", "KP"},
+			// Crimea, Sevastopol, Donetsk, Luhansk
+			Subdivisions: []string{"UA-43", "UA-40", "UA-14", "UA-09"},
+		},
+	}
+}
+
+// resolvePresets returns the enabled presets, overrides replace built-in presets of the same name.
+func resolvePresets(names []string, overrides map[string]Preset) (map[string]Preset, error) {
+	presets := builtinPresets()
+	for name, preset := range overrides {
+		presets[name] = preset
+	}
+	enabled := make(map[string]Preset, len(names))
+	for _, name := range names {
+		preset, ok := presets[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown preset %s", name)
+		}
+		enabled[name] = preset
+	}
+	return enabled, nil
+}
@@ -0,0 +1,165 @@
+package traefikgeoip2
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate limit keys.
+const (
+	RateLimitCountry = "country"
+	RateLimitASN     = "asn"
+	RateLimitIP      = "ip"
+)
+
+// ActionRateLimit the action of requests exceeding a rate limit.
+const ActionRateLimit = "rate_limit"
+
+// DefaultRateLimitKeys the default number of buckets kept per rate limit.
+const DefaultRateLimitKeys = 10000
+
+// RateLimit part of the configuration, a token bucket per country, ASN or client IP,
+// IPv6 clients share the bucket of their /64.
+type RateLimit struct {
+	Key string `json:"key"`
+	// Rate the tokens added per second, Burst the size of the bucket.
+	Rate    float64 `json:"rate"`
+	Burst   int     `json:"burst"`
+	MaxKeys int     `json:"maxKeys,omitempty"`
+}
+
+type rateLimiter struct {
+	key     string
+	rate    float64
+	burst   float64
+	maxKeys int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	// least recently used buckets at the back
+	lru *list.List
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func parseRateLimits(cfgs []RateLimit) ([]*rateLimiter, error) {
+	limiters := make([]*rateLimiter, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		switch cfg.Key {
+		case RateLimitCountry, RateLimitASN, RateLimitIP:
+		default:
+			return nil, fmt.Errorf("invalid rate limit key `%s'", cfg.Key)
+		}
+		if cfg.Rate <= 0 || cfg.Burst < 1 {
+			return nil, fmt.Errorf("rate limit by %s needs a positive rate and burst", cfg.Key)
+		}
+		maxKeys := cfg.MaxKeys
+		if maxKeys <= 0 {
+			maxKeys = DefaultRateLimitKeys
+		}
+		limiters = append(limiters, &rateLimiter{
+			key:     cfg.Key,
+			rate:    cfg.Rate,
+			burst:   float64(cfg.Burst),
+			maxKeys: maxKeys,
+			buckets: map[string]*list.Element{},
+			lru:     list.New(),
+		})
+	}
+	return limiters, nil
+}
+
+// rateLimit takes a token from every matching bucket, the decision names the first exhausted one.
+func (mw *TraefikGeoIP2) rateLimit(record *GeoIPResult, ip net.IP) decision {
+	now := time.Now()
+	for _, l := range mw.rateLimits {
+		key, ok := l.keyOf(record, ip)
+		if !ok {
+			continue
+		}
+		if wait := l.take(key, now); wait > 0 {
+			reason := l.key + ":" + key
+			if l.key == RateLimitIP {
+				// metrics must not get a label per client
+				reason = l.key
+			}
+			return decision{action: ActionRateLimit, reason: reason, retryAfter: wait}
+		}
+	}
+	return decision{}
+}
+
+func (l *rateLimiter) keyOf(record *GeoIPResult, ip net.IP) (string, bool) {
+	switch l.key {
+	case RateLimitCountry:
+		country, ok := record.get(FieldCountry)
+		if !ok {
+			return Unknown, true
+		}
+		return country, true
+	case RateLimitASN:
+		return record.get(FieldASN)
+	default:
+		if ip == nil {
+			return "", false
+		}
+		return clientKey(ip), true
+	}
+}
+
+// clientKey identifies a client by its IPv4 address or IPv6 /64.
+func clientKey(ip net.IP) string {
+	if ip.To4() == nil {
+		return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return ip.String()
+}
+
+// take removes a token from the bucket of the key,
+// it returns the time until the next token when the bucket is empty.
+func (l *rateLimiter) take(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var b *bucket
+	if elem, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(elem)
+		b = elem.Value.(*bucket)
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	} else {
+		b = &bucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+		for l.lru.Len() > l.maxKeys {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*bucket).key)
+		}
+	}
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// tooManyRequests counts the decision without an audit record, a client over its limit would flood the log.
+func (mw *TraefikGeoIP2) tooManyRequests(rw http.ResponseWriter, d decision) {
+	mw.metrics.count(d)
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.retryAfter.Seconds()))))
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(http.StatusTooManyRequests)
+	_, _ = rw.Write([]byte(http.StatusText(http.StatusTooManyRequests)))
+}
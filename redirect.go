@@ -0,0 +1,198 @@
+package traefikgeoip2
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// DefaultBotUserAgents matches the user agents of common crawlers, they are never redirected.
+const DefaultBotUserAgents = `(?i)bot|crawler|spider|slurp|facebookexternalhit|mediapartners|lighthouse`
+
+// Redirect part of the configuration, the target for visitors of a subdivision, country or continent.
+type Redirect struct {
+	Country     string `json:"country,omitempty"`
+	Continent   string `json:"continent,omitempty"`
+	Subdivision string `json:"subdivision,omitempty"`
+	// Target an origin like `https://example.de` or a path prefix like `/en-us/`,
+	// the request path and query are appended.
+	Target     string `json:"target"`
+	StatusCode int    `json:"statusCode,omitempty"`
+}
+
+// Redirects part of the configuration.
+type Redirects struct {
+	Rules         []Redirect `json:"rules"`
+	OptOutCookie  string     `json:"optOutCookie,omitempty"`
+	OptOutQuery   string     `json:"optOutQuery,omitempty"`
+	ExcludePaths  []string   `json:"excludePaths,omitempty"`
+	BotUserAgents string     `json:"botUserAgents,omitempty"`
+}
+
+type redirectRule struct {
+	field      string
+	code       string
+	target     *url.URL
+	statusCode int
+}
+
+type redirects struct {
+	// rules by field, the most specific field is matched first
+	rules        map[string][]redirectRule
+	optOutCookie string
+	optOutQuery  string
+	excludePaths []string
+	bots         *regexp.Regexp
+}
+
+func parseRedirects(cfg *Redirects) (*redirects, error) {
+	if cfg == nil || len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+	botUserAgents := cfg.BotUserAgents
+	if botUserAgents == "" {
+		botUserAgents = DefaultBotUserAgents
+	}
+	bots, err := regexp.Compile(botUserAgents)
+	if err != nil {
+		return nil, fmt.Errorf("invalid botUserAgents pattern: %w", err)
+	}
+	r := &redirects{
+		rules:        map[string][]redirectRule{},
+		optOutCookie: cfg.OptOutCookie,
+		optOutQuery:  cfg.OptOutQuery,
+		excludePaths: cfg.ExcludePaths,
+		bots:         bots,
+	}
+	for _, rule := range cfg.Rules {
+		var field, code string
+		switch {
+		case rule.Subdivision != "":
+			field, code = FieldSubdivision, rule.Subdivision
+		case rule.Country != "":
+			field, code = FieldCountry, rule.Country
+		case rule.Continent != "":
+			field, code = FieldContinent, rule.Continent
+		default:
+			return nil, fmt.Errorf("redirect to %s needs a country, continent or subdivision", rule.Target)
+		}
+		target, err := url.Parse(rule.Target)
+		if err != nil || (target.Host == "") != (target.Scheme == "") ||
+			(target.Host == "" && !strings.HasPrefix(target.Path, "/")) {
+			return nil, fmt.Errorf("invalid redirect target `%s'", rule.Target)
+		}
+		statusCode := rule.StatusCode
+		switch statusCode {
+		case 0:
+			statusCode = http.StatusFound
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+			http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return nil, fmt.Errorf("invalid redirect status code %d", rule.StatusCode)
+		}
+		r.rules[field] = append(r.rules[field], redirectRule{
+			field:      field,
+			code:       strings.ToUpper(strings.TrimSpace(code)),
+			target:     target,
+			statusCode: statusCode,
+		})
+	}
+	return r, nil
+}
+
+// decide returns the redirect of the matching rule, an empty decision
+// when the request should go on to the backend.
+func (r *redirects) decide(rw http.ResponseWriter, req *http.Request, record *GeoIPResult) decision {
+	if r == nil || r.skip(rw, req) {
+		return decision{}
+	}
+	rule := r.match(record)
+	if rule == nil {
+		return decision{}
+	}
+	location, ok := rule.location(req)
+	if !ok {
+		return decision{}
+	}
+	return decision{
+		action:     ActionRedirect,
+		reason:     "redirect:" + rule.field + ":" + rule.code,
+		location:   location,
+		statusCode: rule.statusCode,
+	}
+}
+
+// redirect answers with the geo redirect, unlike blocks it is not audited.
+func (r *redirects) redirect(rw http.ResponseWriter, req *http.Request, d decision) {
+	// the target depends on the client address, which no Vary header can express
+	rw.Header().Set("Cache-Control", "private, no-store")
+	http.Redirect(rw, req, d.location, d.statusCode)
+}
+
+// skip reports whether the request must not be redirected, the opt-out
+// query parameter sets the opt-out cookie for the following requests.
+func (r *redirects) skip(rw http.ResponseWriter, req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return true
+	}
+	if r.optOutQuery != "" && req.URL.Query().Has(r.optOutQuery) {
+		if r.optOutCookie != "" {
+			http.SetCookie(rw, &http.Cookie{
+				Name:     r.optOutCookie,
+				Value:    "1",
+				Path:     "/",
+				MaxAge:   365 * 24 * 60 * 60,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		return true
+	}
+	if r.optOutCookie != "" {
+		if _, err := req.Cookie(r.optOutCookie); err == nil {
+			return true
+		}
+	}
+	for _, prefix := range r.excludePaths {
+		if strings.HasPrefix(req.URL.Path, prefix) {
+			return true
+		}
+	}
+	return r.bots.MatchString(req.UserAgent())
+}
+
+func (r *redirects) match(record *GeoIPResult) *redirectRule {
+	for _, field := range []string{FieldSubdivision, FieldCountry, FieldContinent} {
+		value, ok := record.get(field)
+		if !ok {
+			continue
+		}
+		for _, code := range strings.Split(value, ",") {
+			for i := range r.rules[field] {
+				if r.rules[field][i].code == strings.ToUpper(code) {
+					return &r.rules[field][i]
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// location returns the target with the request path and query,
+// false when the request already is on the target.
+func (rule *redirectRule) location(req *http.Request) (string, bool) {
+	prefix := strings.TrimSuffix(rule.target.Path, "/")
+	sameHost := rule.target.Host == "" || strings.EqualFold(rule.target.Host, req.Host)
+	if sameHost && (prefix == "" || req.URL.Path == prefix || strings.HasPrefix(req.URL.Path, prefix+"/")) {
+		return "", false
+	}
+
+	location := url.URL{
+		Scheme:   rule.target.Scheme,
+		Host:     rule.target.Host,
+		Path:     prefix + req.URL.Path,
+		RawQuery: req.URL.RawQuery,
+	}
+	return location.String(), true
+}
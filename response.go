@@ -0,0 +1,120 @@
+package traefikgeoip2
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// responseWriter adds the geo headers to the response right before it is written,
+// so they survive whatever the backend does to the header map.
+type responseWriter struct {
+	http.ResponseWriter
+	headers     http.Header
+	vary        []string
+	cookie      *http.Cookie
+	wroteHeader bool
+}
+
+func (a *TraefikGeoIP2) wrapResponse(rw http.ResponseWriter, req *http.Request, record *GeoIPResult) http.ResponseWriter {
+	var cookie *http.Cookie
+	if a.cookie != nil {
+		cookie = a.cookie.cookie(req, record)
+	}
+	if len(a.responseHeaders) == 0 && len(a.vary) == 0 && cookie == nil {
+		return rw
+	}
+	headers := http.Header{}
+	for i := range a.responseHeaders {
+		a.addField(headers, &a.responseHeaders[i], record)
+	}
+	return &responseWriter{ResponseWriter: rw, headers: headers, vary: a.vary, cookie: cookie}
+}
+
+func (w *responseWriter) injectHeaders() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	header := w.ResponseWriter.Header()
+	for name, values := range w.headers {
+		header[name] = values
+	}
+	if len(w.vary) > 0 {
+		addVary(header, w.vary)
+	}
+	if w.cookie != nil {
+		header.Add("Set-Cookie", w.cookie.String())
+	}
+	if len(w.headers) > 0 || w.cookie != nil {
+		// shared caches in front of Traefik never see the request geo headers, Vary cannot key them
+		markPrivate(header)
+	}
+}
+
+// markPrivate keeps shared caches from storing a response that carries the client's geo data,
+// directives allowing them to are dropped.
+func markPrivate(header http.Header) {
+	directives := []string{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			switch name := strings.ToLower(strings.SplitN(directive, "=", 2)[0]); name {
+			case "private", "no-store":
+				return
+			case "", "public", "s-maxage":
+			default:
+				directives = append(directives, directive)
+			}
+		}
+	}
+	header.Set("Cache-Control", strings.Join(append([]string{"private"}, directives...), ", "))
+}
+
+func addVary(header http.Header, names []string) {
+	present := map[string]bool{}
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			present[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+	if present["*"] {
+		return
+	}
+	for _, name := range names {
+		if !present[http.CanonicalHeaderKey(name)] {
+			present[http.CanonicalHeaderKey(name)] = true
+			header.Add("Vary", name)
+		}
+	}
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	w.injectHeaders()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.injectHeaders()
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher.
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.injectHeaders()
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T is not a http.Hijacker", w.ResponseWriter)
+	}
+	return h.Hijack()
+}
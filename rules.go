@@ -0,0 +1,140 @@
+package traefikgeoip2
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Rule part of the configuration, an action for the requests matching hosts, paths,
+// methods and optionally countries or continents. Every configured criterion must match.
+type Rule struct {
+	Name         string   `json:"name,omitempty"`
+	Hosts        []string `json:"hosts,omitempty"`
+	PathPrefixes []string `json:"pathPrefixes,omitempty"`
+	PathRegex    string   `json:"pathRegex,omitempty"`
+	Methods      []string `json:"methods,omitempty"`
+	Countries    []string `json:"countries,omitempty"`
+	Continents   []string `json:"continents,omitempty"`
+	// Action allow skips every check, deny blocks, tag names the rule in the rule field
+	// and leaves the request to the other checks.
+	Action     string `json:"action"`
+	ReportOnly bool   `json:"reportOnly,omitempty"`
+}
+
+type rule struct {
+	name         string
+	hosts        []string
+	pathPrefixes []string
+	pathRegex    *regexp.Regexp
+	methods      map[string]bool
+	countries    map[string]bool
+	continents   map[string]bool
+	action       string
+	reportOnly   bool
+}
+
+func parseRules(cfgs []Rule) ([]*rule, error) {
+	rules := make([]*rule, 0, len(cfgs))
+	for i, cfg := range cfgs {
+		r := &rule{
+			name:         cfg.Name,
+			pathPrefixes: cfg.PathPrefixes,
+			countries:    countrySet(cfg.Countries),
+			continents:   countrySet(cfg.Continents),
+			action:       cfg.Action,
+			reportOnly:   cfg.ReportOnly,
+		}
+		if r.name == "" {
+			r.name = strconv.Itoa(i)
+		}
+		switch cfg.Action {
+		case ActionAllow, ActionDeny, ActionTag:
+		default:
+			return nil, fmt.Errorf("invalid action `%s' of rule %s", cfg.Action, r.name)
+		}
+		for _, host := range cfg.Hosts {
+			host = strings.ToLower(host)
+			if _, err := path.Match(host, ""); err != nil {
+				return nil, fmt.Errorf("invalid host pattern %s of rule %s: %w", host, r.name, err)
+			}
+			r.hosts = append(r.hosts, host)
+		}
+		if cfg.PathRegex != "" {
+			re, err := regexp.Compile(cfg.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path pattern of rule %s: %w", r.name, err)
+			}
+			r.pathRegex = re
+		}
+		if len(cfg.Methods) > 0 {
+			r.methods = make(map[string]bool, len(cfg.Methods))
+			for _, method := range cfg.Methods {
+				r.methods[strings.ToUpper(method)] = true
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// matchRule returns the first rule matching the request, nil if none does.
+func matchRule(rules []*rule, req *http.Request, record *GeoIPResult) *rule {
+	for _, r := range rules {
+		if r.matches(req, record) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (r *rule) matches(req *http.Request, record *GeoIPResult) bool {
+	if len(r.hosts) > 0 {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !matchAny(r.hosts, strings.ToLower(host)) {
+			return false
+		}
+	}
+	if len(r.pathPrefixes) > 0 && !hasAnyPrefix(req.URL.Path, r.pathPrefixes) {
+		return false
+	}
+	if r.pathRegex != nil && !r.pathRegex.MatchString(req.URL.Path) {
+		return false
+	}
+	if r.methods != nil && !r.methods[req.Method] {
+		return false
+	}
+	if r.countries != nil || r.continents != nil {
+		country, _ := record.get(FieldCountry)
+		continent, _ := record.get(FieldContinent)
+		if !r.countries[strings.ToUpper(country)] && !r.continents[strings.ToUpper(continent)] {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyPrefix(value string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
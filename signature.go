@@ -0,0 +1,119 @@
+package traefikgeoip2
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signature part of the configuration, an HMAC-SHA256 over the emitted geo headers,
+// a timestamp and the client IP.
+type Signature struct {
+	Header string `json:"header"`
+	Secret string `json:"secret"`
+}
+
+type signer struct {
+	header  string
+	secret  []byte
+	headers []string
+}
+
+func parseSignature(cfg *Signature, headers []string) (*signer, error) {
+	if cfg == nil || cfg.Header == "" {
+		return nil, nil
+	}
+	if cfg.Secret == "" {
+		return nil, errors.New("signature secret must not be empty")
+	}
+	names := make([]string, 0, len(headers))
+	seen := map[string]bool{}
+	for _, name := range headers {
+		name = strings.ToLower(name)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return &signer{header: cfg.Header, secret: []byte(cfg.Secret), headers: names}, nil
+}
+
+func (a *TraefikGeoIP2) addSignatureHeader(req *http.Request, clientIP string) {
+	if a.signature == nil {
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := signHeaders(a.signature.secret, req.Header, a.signature.headers, timestamp, clientIP)
+	req.Header.Set(a.signature.header,
+		"t="+timestamp+";h="+strings.Join(a.signature.headers, ",")+";s="+sig)
+}
+
+// signHeaders signs one line per header, `name:value1,value2`, after the timestamp and the client IP.
+func signHeaders(secret []byte, header http.Header, names []string, timestamp, clientIP string) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n", timestamp, clientIP)
+	for _, name := range names {
+		fmt.Fprintf(mac, "%s:%s\n", name, strings.Join(header.Values(name), ","))
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignatureVerifier checks the signature header added by the middleware.
+type SignatureVerifier struct {
+	Header string
+	Secret string
+	MaxAge time.Duration
+}
+
+// Verify checks the signature of the geo headers for the client IP
+// and, when MaxAge is set, that the signature is recent enough.
+func (v *SignatureVerifier) Verify(header http.Header, clientIP string) error {
+	value := header.Get(v.Header)
+	if value == "" {
+		return errors.New("missing geo signature")
+	}
+
+	var timestamp, names, sig string
+	for _, part := range strings.Split(value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return errors.New("malformed geo signature")
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "h":
+			names = kv[1]
+		case "s":
+			sig = kv[1]
+		}
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed geo signature timestamp: %w", err)
+	}
+	if v.MaxAge > 0 {
+		age := time.Since(time.Unix(ts, 0))
+		if age > v.MaxAge || age < -v.MaxAge {
+			return errors.New("expired geo signature")
+		}
+	}
+
+	var list []string
+	if names != "" {
+		list = strings.Split(names, ",")
+	}
+	expected := signHeaders([]byte(v.Secret), header, list, timestamp, clientIP)
+	if !hmac.Equal([]byte(expected), []byte(sig)) {
+		return errors.New("invalid geo signature")
+	}
+	return nil
+}
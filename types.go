@@ -3,29 +3,89 @@ package traefikgeoip2
 import (
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/IncSW/geoip2"
 )
 
-// Unknown constant for undefined data.
+// Unknown constant for undefined data, the default placeholder.
 const Unknown = "XX"
 
+// Modes for headers of fields missing from the lookup result.
+const (
+	MissingPlaceholder = "placeholder"
+	MissingOmit        = "omit"
+	MissingEmpty       = "empty"
+)
+
 const (
 	// RealIPHeader real ip header.
 	RealIPHeader = "X-Real-IP"
+	// WouldBlockHeader reports the decision of report-only policies to the backend.
+	WouldBlockHeader = "X-Geo-Policy-Would-Block"
 )
 
 const DefaultCacheExpire = 30 * time.Minute
 const DefaultCachePurge = 2 * time.Hour
 
-// GeoIPResult GeoIPResult.
+// Result field identifiers.
+const (
+	FieldCountry      = "country"
+	FieldCountryName  = "country_name"
+	FieldContinent    = "continent"
+	FieldRegion       = "region"
+	FieldRegionName   = "region_name"
+	FieldSubdivision  = "subdivisions"
+	FieldCity         = "city"
+	FieldLatitude     = "latitude"
+	FieldLongitude    = "longitude"
+	FieldAccuracy     = "accuracy_radius"
+	FieldEU           = "eu"
+	FieldOrg          = "organization"
+	FieldASN          = "asn"
+	FieldASOrg        = "asn_organization"
+	FieldAnonymizer   = "anonymizer"
+	FieldGeofence     = "geofence"
+	FieldRule         = "rule"
+	FieldTags         = "tags"
+	FieldFeatureFlags = "feature_flags"
+)
+
+// Lookup statuses.
+const (
+	StatusOK            = "ok"
+	StatusRewrite       = "rewrite"
+	StatusNotFound      = "not_found"
+	StatusPrivate       = "private"
+	StatusInvalidIP     = "invalid_ip"
+	StatusDBUnavailable = "db_unavailable"
+	StatusError         = "error"
+)
+
+// GeoIPResult GeoIPResult, holds only the fields actually present in the lookup.
 type GeoIPResult struct {
-	country   string
-	region    string
-	city      string
-	latitude  string
-	longitude string
+	fields map[string]string
+	status string
+	source string
+	// Anonymous-IP flags set for the address
+	anonymizers []string
+}
+
+func newGeoIPResult() *GeoIPResult {
+	return &GeoIPResult{fields: map[string]string{}}
+}
+
+func (r *GeoIPResult) set(field, value string) {
+	if value != "" {
+		r.fields[field] = value
+	}
+}
+
+func (r *GeoIPResult) get(field string) (string, bool) {
+	value, ok := r.fields[field]
+	return value, ok
 }
 
 // LookupGeoIP2 LookupGeoIP2.
@@ -38,17 +98,40 @@ func CreateCityDBLookup(rdr *geoip2.CityReader) LookupGeoIP2 {
 		if err != nil {
 			return nil, fmt.Errorf("%w", err)
 		}
-		retval := GeoIPResult{
-			country:   rec.Country.ISOCode,
-			region:    Unknown,
-			city:      rec.City.Names["en"],
-			latitude:  fmt.Sprintf("%f", rec.Location.Latitude),
-			longitude: fmt.Sprintf("%f", rec.Location.Longitude),
+		retval := newGeoIPResult()
+		retval.set(FieldCountry, rec.Country.ISOCode)
+		retval.set(FieldCountryName, rec.Country.Names["en"])
+		retval.set(FieldContinent, rec.Continent.Code)
+		retval.set(FieldCity, rec.City.Names["en"])
+		if len(rec.Subdivisions) > 0 {
+			retval.set(FieldRegion, rec.Subdivisions[0].ISOCode)
+			retval.set(FieldRegionName, rec.Subdivisions[0].Names["en"])
+		}
+		// ISO 3166-2 codes of all subdivisions, e.g. `UA-43`
+		codes := make([]string, 0, len(rec.Subdivisions))
+		for _, sub := range rec.Subdivisions {
+			if sub.ISOCode != "" && rec.Country.ISOCode != "" {
+				codes = append(codes, rec.Country.ISOCode+"-"+sub.ISOCode)
+			}
+		}
+		retval.set(FieldSubdivision, strings.Join(codes, ","))
+		retval.set(FieldOrg, rec.Traits.Organization)
+		if rec.Traits.AutonomousSystemNumber != 0 {
+			retval.set(FieldASN, strconv.FormatUint(uint64(rec.Traits.AutonomousSystemNumber), 10))
+		}
+		retval.set(FieldASOrg, rec.Traits.AutonomousSystemOrganization)
+		// The reader does not report absent keys, a zero location means no location.
+		if rec.Location.Latitude != 0 || rec.Location.Longitude != 0 || rec.Location.AccuracyRadius != 0 {
+			retval.set(FieldLatitude, fmt.Sprintf("%f", rec.Location.Latitude))
+			retval.set(FieldLongitude, fmt.Sprintf("%f", rec.Location.Longitude))
+		}
+		if rec.Location.AccuracyRadius != 0 {
+			retval.set(FieldAccuracy, strconv.Itoa(int(rec.Location.AccuracyRadius)))
 		}
-		if rec.Subdivisions != nil {
-			retval.region = rec.Subdivisions[0].ISOCode
+		if rec.Country.ISOCode != "" {
+			retval.set(FieldEU, strconv.FormatBool(rec.Country.IsInEuropeanUnion))
 		}
-		return &retval, nil
+		return retval, nil
 	}
 }
 
@@ -59,11 +142,13 @@ func CreateCountryDBLookup(rdr *geoip2.CountryReader) LookupGeoIP2 {
 		if err != nil {
 			return nil, fmt.Errorf("%w", err)
 		}
-		retval := GeoIPResult{
-			country: rec.Country.ISOCode,
-			region:  Unknown,
-			city:    Unknown,
+		retval := newGeoIPResult()
+		retval.set(FieldCountry, rec.Country.ISOCode)
+		retval.set(FieldCountryName, rec.Country.Names["en"])
+		retval.set(FieldContinent, rec.Continent.Code)
+		if rec.Country.ISOCode != "" {
+			retval.set(FieldEU, strconv.FormatBool(rec.Country.IsInEuropeanUnion))
 		}
-		return &retval, nil
+		return retval, nil
 	}
 }